@@ -6,7 +6,16 @@ package main
 // filter - filter packets by this keyword
 // count - number of packets inside each output file
 // log-dir - path to directory with output files
-// log-dir-threshold - max size of log directory in Mb (script is automatically removes old files)
+// log-dir-threshold - max size of <i>.<ts>.pcap files in log directory in Mb (script is automatically removes old files),
+//                     other files in log directory are not counted
+// min-free - keep at least this much free space on log-dir filesystem (e.g. 2G or 10%), old <i>.<ts>.pcap files are removed to get it;
+//            if nothing more can be removed, packets are dropped (with a warning) until space is available again
+// manifest - keep <i>.index.jsonl in log-dir with one entry per finished file (name, first/last packet time, packets, size, sha256),
+//            entries of removed files are dropped from it
+// fsync - when written packets are synced to disk: always (after each packet), <duration> (e.g. 200ms, at most this long after a packet),
+//         rotate (when file is closed) or never (left to OS); packets are written through a buffer which goes to the file
+//         when no more packets are waiting and always when file is closed
+// active file is written as <name>.partial and renamed when it's finished; log-dir/current is a symlink to active file
 //
 
 import "fmt"
@@ -18,6 +27,17 @@ import "errors"
 import "flag"
 import "strings"
 import "path/filepath"
+import "regexp"
+import "strconv"
+import "sync"
+import "sync/atomic"
+import "syscall"
+import "io"
+import "bufio"
+import "hash"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
 import "github.com/google/gopacket"
 import "github.com/google/gopacket/pcap"
 import "github.com/google/gopacket/pcapgo"
@@ -32,8 +52,38 @@ var logDirNotExists    = errors.New("log-dir doesn't exist")
 var deviceNotExists    = errors.New("device doesn't exist")
 var unableToOpenDevice = errors.New("unable to open device")
 var unableToSetFilter  = errors.New("unable to set such filter")
+var badMinFree         = errors.New("min-free should be a size (e.g. 2G) or a percentage (e.g. 10%)")
+var badFsync           = errors.New("fsync should be one of: always, rotate, never or a duration (e.g. 200ms)")
+
+const partialSuffix = ".partial"
+
+const (
+    fsyncAlways    = "always"
+    fsyncInterval  = "interval"
+    fsyncRotate    = "rotate"
+    fsyncNever     = "never"
+)
 //
 
+// fileStats is collected while file is written and goes to manifest when file is closed
+type fileStats struct {
+    first              time.Time
+    last               time.Time
+    packets            int
+    hash               hash.Hash
+}
+
+// manifestEntry is a single line of <i>.index.jsonl
+type manifestEntry struct {
+    File               string    `json:"file"`
+    First              time.Time `json:"first"`
+    Last               time.Time `json:"last"`
+    Packets            int       `json:"packets"`
+    Size               int64     `json:"size"`
+    Compression        string    `json:"compression"`
+    Sha256             string    `json:"sha256"`
+}
+
 type Runner struct {
 
     interfaceName      string
@@ -51,23 +101,33 @@ type Runner struct {
     packets            chan gopacket.Packet
     packet_source      *gopacket.PacketSource
     handle             *pcap.Handle
+    min_free_bytes     int64
+    min_free_percent   float64
+    own_pattern        *regexp.Regexp
+    cleanUpMu          sync.Mutex
+    paused             int32
+    pausedDropped      int64
+    manifest           string
+    manifestMu         sync.Mutex
+    fsync              string
+    fsync_interval     time.Duration
 
 }
 
 func main() {
 
-    interfaceName,filter,logDir,count,logDirThreshold,compress,err := parseInput()
+    interfaceName,filter,logDir,count,logDirThreshold,compress,minFree,manifest,fsync,err := parseInput()
     //fmt.Printf("Flags:\n%v %v %v %v\n",cmd_line,logDir,count,compress)
 
     if err != nil { fmt.Printf("error:%v\n",err) ; return }
 
-    runner,err := NewRunner(interfaceName,filter,logDir,count,logDirThreshold,compress)
+    runner,err := NewRunner(interfaceName,filter,logDir,count,logDirThreshold,compress,minFree,manifest,fsync)
     if err != nil { fmt.Printf("error:%v\n",err) ; return }
 
     runner.run()
 }
 
-func parseInput()(interfaceName string, filter string, logDir string, count int, log_dir_threshold int, compress bool,  err error){
+func parseInput()(interfaceName string, filter string, logDir string, count int, log_dir_threshold int, compress bool, minFree string, manifest bool, fsync string, err error){
 
     interfaceNamePtr   := flag.String("i","","Interface name")
     filterPtr          := flag.String("filter","","Capture filter")
@@ -75,6 +135,9 @@ func parseInput()(interfaceName string, filter string, logDir string, count int,
     countPtr           := flag.Int("count",0,"Packets count inside each file")
     logDirThresholdPtr := flag.Int("log-dir-threshold",100,"Maximum log directory size MB")
     compressPtr        := flag.Bool("compress",false,"Compress")
+    minFreePtr         := flag.String("min-free","","Minimum free space on log-dir filesystem (e.g. 2G or 10%)")
+    manifestPtr        := flag.Bool("manifest",true,"Keep <i>.index.jsonl manifest of finished files")
+    fsyncPtr           := flag.String("fsync",fsyncAlways,"When packets are synced to disk: always, <duration>, rotate, never")
 
     flag.Parse()
 
@@ -84,6 +147,9 @@ func parseInput()(interfaceName string, filter string, logDir string, count int,
     if countPtr           != nil {  count             = *countPtr           } else { err = parseError ; return }
     if logDirThresholdPtr != nil {  log_dir_threshold = *logDirThresholdPtr } else { err = parseError ; return }
     if compressPtr        != nil {  compress          = *compressPtr        } else { err = parseError ; return }
+    if minFreePtr         != nil {  minFree           = *minFreePtr         } else { err = parseError ; return }
+    if manifestPtr        != nil {  manifest          = *manifestPtr        } else { err = parseError ; return }
+    if fsyncPtr           != nil {  fsync             = *fsyncPtr           } else { err = parseError ; return }
 
     if interfaceName == "" { err = interfaceNameEmpty ; return }
     if count          < 1  { err = countTooShort      ; return }
@@ -92,11 +158,16 @@ func parseInput()(interfaceName string, filter string, logDir string, count int,
 
 }
 
-func NewRunner( interfaceName string, filter string, log_dir string, count int, log_dir_threshold int, compress bool )( *Runner , error){
+func NewRunner( interfaceName string, filter string, log_dir string, count int, log_dir_threshold int, compress bool, minFree string, manifest bool, fsync string )( *Runner , error){
     // prepare new runner
     var r   Runner
     var err error
     //
+    r.min_free_bytes,r.min_free_percent,err = parseMinFree(minFree)
+    if err != nil { return nil, err }
+    r.fsync,r.fsync_interval,err = parseFsync(fsync)
+    if err != nil { return nil, err }
+    //
     var snapshotLen uint32  = 1024
     var promiscuous bool   = false
     var timeout     time.Duration = -1 * time.Second
@@ -129,6 +200,9 @@ func NewRunner( interfaceName string, filter string, log_dir string, count int,
     r.compress          = compress
     r.timeout_sec       = 2
     r.link_type         = layers.LinkTypeEthernet
+    if manifest { r.manifest = r.log_dir + interfaceName + ".index.jsonl" }
+    // .partial left after crash is removed by retention as any other file
+    r.own_pattern       = regexp.MustCompile(`^`+regexp.QuoteMeta(interfaceName)+`\.[0-9]{14}\.pcap(\.partial)?$`)
     //
     r.packet_source     = gopacket.NewPacketSource(handle, handle.LinkType())
     //
@@ -142,6 +216,10 @@ func NewRunner( interfaceName string, filter string, log_dir string, count int,
     fmt.Printf("\n\tcompress:%v",r.compress)
     fmt.Printf("\n\ttimeout_sec:%v",r.timeout_sec)
     fmt.Printf("\n\tlink_type:%v",r.link_type)
+    fmt.Printf("\n\tmin_free_bytes:%v",r.min_free_bytes)
+    fmt.Printf("\n\tmin_free_percent:%v",r.min_free_percent)
+    fmt.Printf("\n\tmanifest:%v",r.manifest)
+    fmt.Printf("\n\tfsync:%v %v",r.fsync,r.fsync_interval)
     fmt.Printf("\n")
     //
     return &r, nil
@@ -149,6 +227,14 @@ func NewRunner( interfaceName string, filter string, log_dir string, count int,
 
 func (r *Runner)run()(error){
     go r.processing()
+    if r.min_free_bytes > 0 || r.min_free_percent > 0 {
+        // nothing is rotated while capture is paused, so check free space on timer too
+        go func() {
+            for range time.Tick(time.Second * r.timeout_sec * 5) {
+                r.cleanUp()
+            }
+        }()
+    }
     r.catchExit()
     return nil
 
@@ -158,8 +244,8 @@ func(r *Runner)catchExit()(){
 
     signalChan  := make(chan os.Signal, 1)
     cleanupDone := make(chan bool)
-    signal.Notify(signalChan, os.Interrupt)
-    signal.Notify(signalChan, os.Kill)
+    // SIGKILL can't be caught, SIGTERM is what systemd sends on stop
+    signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
     go func() {
         for _ = range signalChan {
             r.quitProcessing<-true
@@ -177,76 +263,214 @@ func(r *Runner)catchExit()(){
 
 func (r *Runner)processing()(){
     //
-    finish := false
     var f *os.File
+    var bw *bufio.Writer
     var w *pcapgo.Writer
     var err error
     var logName string
     //
     blank   := true
-    counter := 0
+    var stats fileStats
+    // fires fsync interval after first unsynced packet
+    var syncTimer *time.Timer
+    var syncC     <-chan time.Time
     //
+    loop:
     for {
         select {
             case packet:=<-r.packet_source.Packets():
                     if packet == nil { continue }
+                    if atomic.LoadInt32(&r.paused) == 1 {
+                        // disk is full and nothing can be removed
+                        atomic.AddInt64(&r.pausedDropped, 1)
+                        continue
+                    }
                     if blank {
                         // prepare new filename
-                        if f!=nil      { f.Sync()  ; f.Close()  ; f = nil     }
-                        counter     =  0
+                        if f!=nil      { r.closeCaptureFile(f, bw, stats) ; f = nil }
+                        if syncTimer != nil { syncTimer.Stop() ; syncTimer = nil ; syncC = nil }
+                        stats       =  fileStats{hash:sha256.New()}
                         t           := time.Now()
                         timestamp   := t.Format("20060102150405")
                         logName     =  timestamp+".pcap"
                         logName = r.interfaceName + "." + logName
                         //fmt.Printf("\ncreate file: %v\n",r.log_dir + logName)
-                        new_file_name := r.log_dir + logName
+                        // file gets its final name only when it's closed
+                        new_file_name := r.log_dir + logName + partialSuffix
                         f, err = os.Create(new_file_name)
                         if err != nil { break }
-                        w = pcapgo.NewWriter(f)
+                        bw = bufio.NewWriterSize(f, 256*1024)
+                        w = pcapgo.NewWriter(io.MultiWriter(bw, stats.hash))
                         err = w.WriteFileHeader(uint32(r.snapshot_len), r.link_type)
                         if err != nil { break }
                         blank = false
                         r.currentLogFile = new_file_name
+                        r.updateCurrentLink(new_file_name)
                         go r.cleanUp()
                     }
-                    w.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
-                    f.Sync()
-                    counter += 1
-                    if (counter >= r.count) || ( err!= nil )  { blank = true }
+                    ci := packet.Metadata().CaptureInfo
+                    w.WritePacket(ci, packet.Data())
+                    r.flushRecord(f, bw, len(r.packet_source.Packets()) > 0)
+                    if r.fsync == fsyncInterval && syncTimer == nil {
+                        syncTimer = time.NewTimer(r.fsync_interval)
+                        syncC     = syncTimer.C
+                    }
+                    if stats.packets == 0 { stats.first = ci.Timestamp }
+                    stats.last     = ci.Timestamp
+                    stats.packets += 1
+                    if (stats.packets >= r.count) || ( err!= nil )  { blank = true }
                     //fmt.Println(s)
+            case <-syncC:
+                syncTimer, syncC = nil, nil
+                if f != nil && bw.Flush() == nil { f.Sync() }
             case <-r.quitProcessing:
-                finish = true
-            default:
-                if finish { break }
-                time.Sleep(time.Second * r.timeout_sec)
+                // plain break would leave only select, so file is never finished
+                break loop
         }
     }
-    if f!=nil      { f.Sync() ;  f.Close() ; f = nil }
+    if f!=nil      { r.closeCaptureFile(f, bw, stats) ; f = nil }
+    r.updateCurrentLink("")
     r.quit<-true
 }
 
+// cleanUp removes oldest capture files while log-dir is over threshold or filesystem is below min-free
 func(r *Runner)cleanUp()(err error){
     //
-    dirSizeMb,err := DirSizeMb(r.log_dir)
-    if err!=nil{return}
+    r.cleanUpMu.Lock()
+    defer r.cleanUpMu.Unlock()
+    defer r.updatePause()
     threshold     := r.log_dir_threshold
-    if dirSizeMb>threshold{
-        fmt.Printf("\nThreshold is fired:\tlog-dir max size threshold: %v\tlog-dir current size: %v",threshold,dirSizeMb)
+    var removed []string
+    defer func() { r.manifestRemove(removed) }()
+    for {
+        var dirSizeMb int
+        dirSizeMb,err = ownFilesSizeMb(r.log_dir, r.own_pattern)
+        if err!=nil{return}
+        lowDisk   := r.lowDiskSpace()
+        if dirSizeMb<=threshold && !lowDisk { return nil }
+        if lowDisk {
+            fmt.Printf("\nThreshold is fired:\tmin free space: %v bytes / %v%%",r.min_free_bytes,r.min_free_percent)
+        } else {
+            fmt.Printf("\nThreshold is fired:\tlog-dir max size threshold: %v\tlog-dir current size: %v",threshold,dirSizeMb)
+        }
         var oldestFile string
-        oldestFile,err = getOldestFile(r.log_dir)
-        oldestFile     = r.log_dir+oldestFile
+        oldestFile,err = getOldestFile(r.log_dir, r.own_pattern, r.currentLogFile)
         if err != nil { return }
-        _, err = os.Stat(oldestFile)
-        if os.IsNotExist(err) { return fileDoesntExist }
-        if  oldestFile == r.currentLogFile { return nil }
+        // only current file is left
+        if oldestFile == "" { return nil }
         fmt.Printf("\nRemoving file %v",oldestFile)
-        return os.Remove(oldestFile)
+        err = os.Remove(oldestFile)
+        if err != nil && !os.IsNotExist(err) { return }
+        removed = append(removed, filepath.Base(oldestFile))
         //
     }
-    return nil
     //
 }
 
+// flushRecord is called after each packet written to bw, pending tells that more packets are waiting
+func (r *Runner)flushRecord(f *os.File, bw *bufio.Writer, pending bool)(){
+    if r.fsync == fsyncAlways {
+        if bw.Flush() == nil { f.Sync() }
+        return
+    }
+    if !pending { bw.Flush() }
+}
+
+func (r *Runner)closeCaptureFile(f *os.File, bw *bufio.Writer, stats fileStats)(){
+    partialName := f.Name()
+    if err := bw.Flush() ; err != nil { fmt.Printf("\nUnable to write %v: %v",partialName,err) }
+    if r.fsync != fsyncNever { f.Sync() }
+    f.Close()
+    name := strings.TrimSuffix(partialName, partialSuffix)
+    if err := os.Rename(partialName, name) ; err != nil {
+        fmt.Printf("\nUnable to rename %v: %v",partialName,err)
+        name = partialName
+    }
+    entry := manifestEntry{
+        File:        filepath.Base(name),
+        First:       stats.first,
+        Last:        stats.last,
+        Packets:     stats.packets,
+        Compression: "none",
+        Sha256:      hex.EncodeToString(stats.hash.Sum(nil)),
+    }
+    if info, err := os.Stat(name) ; err == nil { entry.Size = info.Size() }
+    r.manifestAppend(entry)
+}
+
+// updateCurrentLink points log_dir/current to active file, empty name removes the link
+func (r *Runner)updateCurrentLink(name string)(){
+    link := r.log_dir + "current"
+    if name == "" { os.Remove(link) ; return }
+    // symlink is replaced atomically with rename, relative target keeps it valid if log_dir is moved
+    tmpLink := link + ".tmp"
+    os.Remove(tmpLink)
+    err := os.Symlink(filepath.Base(name), tmpLink)
+    if err == nil { err = os.Rename(tmpLink, link) }
+    if err != nil { fmt.Printf("\nUnable to update %v: %v",link,err) }
+}
+
+func (r *Runner)manifestAppend(entry manifestEntry)(){
+    if r.manifest == "" { return }
+    r.manifestMu.Lock()
+    defer r.manifestMu.Unlock()
+    data, err := json.Marshal(entry)
+    if err != nil { return }
+    f, err := os.OpenFile(r.manifest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil { fmt.Printf("\nUnable to open manifest %v: %v",r.manifest,err) ; return }
+    defer f.Close()
+    _, err = f.Write(append(data, '\n'))
+    if err != nil { fmt.Printf("\nUnable to write manifest %v: %v",r.manifest,err) }
+}
+
+// manifestRemove drops entries of removed files, manifest is rewritten via temporary file and rename
+func (r *Runner)manifestRemove(files []string)(){
+    if r.manifest == "" || len(files) == 0 { return }
+    r.manifestMu.Lock()
+    defer r.manifestMu.Unlock()
+    gone := make(map[string]bool)
+    for _, name := range files { gone[name] = true }
+    src, err := os.Open(r.manifest)
+    if err != nil { return }
+    defer src.Close()
+    tmpName := r.manifest + ".tmp"
+    dst, err := os.Create(tmpName)
+    if err != nil { fmt.Printf("\nUnable to rewrite manifest %v: %v",r.manifest,err) ; return }
+    scanner := bufio.NewScanner(src)
+    scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+    for scanner.Scan() {
+        var entry manifestEntry
+        // broken lines are kept as they are
+        if json.Unmarshal(scanner.Bytes(), &entry) == nil && gone[entry.File] { continue }
+        dst.Write(append(scanner.Bytes(), '\n'))
+    }
+    err = scanner.Err()
+    if err == nil { err = dst.Sync() }
+    if cerr := dst.Close() ; err == nil { err = cerr }
+    if err == nil { err = os.Rename(tmpName, r.manifest) }
+    if err != nil { os.Remove(tmpName) ; fmt.Printf("\nUnable to rewrite manifest %v: %v",r.manifest,err) }
+}
+
+func (r *Runner)lowDiskSpace()(bool){
+    if r.min_free_bytes == 0 && r.min_free_percent == 0 { return false }
+    free, total, err := diskFree(r.log_dir)
+    if err != nil { fmt.Printf("\nUnable to statfs %v: %v",r.log_dir,err) ; return false }
+    if r.min_free_bytes > 0 && free < uint64(r.min_free_bytes) { return true }
+    if r.min_free_percent > 0 && total > 0 && float64(free)*100/float64(total) < r.min_free_percent { return true }
+    return false
+}
+
+// updatePause stops writing when disk is still low after cleanUp had nothing more to remove
+func (r *Runner)updatePause()(){
+    low := r.lowDiskSpace()
+    if low && atomic.CompareAndSwapInt32(&r.paused, 0, 1) {
+        fmt.Printf("\n!!! WARNING: free space on %v is below min-free and there is nothing more to remove, capture is PAUSED, packets are dropped !!!",r.log_dir)
+    }
+    if !low && atomic.CompareAndSwapInt32(&r.paused, 1, 0) {
+        fmt.Printf("\nfree space on %v is available again, capture is resumed (%v packets were dropped)",r.log_dir,atomic.SwapInt64(&r.pausedDropped, 0))
+    }
+}
+
 
 func Command(args []string) (cmd *exec.Cmd,err error) {
     // overwriting existing exec.Command  function 
@@ -266,10 +490,13 @@ func Command(args []string) (cmd *exec.Cmd,err error) {
     return cmd, nil
 }
 
-func DirSizeMb(path string) (int, error) {
+// ownFilesSizeMb counts only files which cleanUp may remove (and current one), so foreign files don't make it remove all captures
+func ownFilesSizeMb(dir_path string, pattern *regexp.Regexp) (int, error) {
     var size        int64
-    err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-        if !info.IsDir() {
+    err := filepath.Walk(dir_path, func(path string, info os.FileInfo, err error) error {
+        if err != nil { return err }
+        if info.IsDir() && filepath.Clean(path) != filepath.Clean(dir_path) { return filepath.SkipDir }
+        if info.Mode().IsRegular() && pattern.MatchString(info.Name()) {
             size += info.Size()
         }
         return err
@@ -278,14 +505,17 @@ func DirSizeMb(path string) (int, error) {
     return sizeMB, err
 }
 
-func getOldestFile(dir_path string) (filename string,err error) {
+// only files matching pattern directly inside dir_path are considered, current file is skipped
+func getOldestFile(dir_path string, pattern *regexp.Regexp, current string) (filename string,err error) {
     first_iter := true
     var fTgtName  string
     var fTgtMtime time.Time
 
-    err = filepath.Walk(dir_path, func(_ string, info os.FileInfo, err error) error {
-        if !info.IsDir() {
-            fname  := info.Name()
+    err = filepath.Walk(dir_path, func(path string, info os.FileInfo, err error) error {
+        if err != nil { return err }
+        if info.IsDir() && filepath.Clean(path) != filepath.Clean(dir_path) { return filepath.SkipDir }
+        if info.Mode().IsRegular() && pattern.MatchString(info.Name()) && filepath.Clean(path) != filepath.Clean(current) {
+            fname  := path
             fmtime := info.ModTime()
             if first_iter {
                 fTgtName   = fname
@@ -303,6 +533,49 @@ func getOldestFile(dir_path string) (filename string,err error) {
 }
 
 
+// parseMinFree accepts size (2G, 512M) or percentage of filesystem (10%)
+func parseMinFree(value string)(bytes int64, percent float64, err error){
+    value = strings.TrimSpace(strings.ToUpper(value))
+    if value == "" { return 0, 0, nil }
+    if strings.HasSuffix(value, "%") {
+        percent, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+        if err != nil || percent < 0 || percent >= 100 { return 0, 0, badMinFree }
+        return 0, percent, nil
+    }
+    multiplier := int64(1)
+    switch {
+        case strings.HasSuffix(value, "K"): multiplier = 1024
+        case strings.HasSuffix(value, "M"): multiplier = 1024*1024
+        case strings.HasSuffix(value, "G"): multiplier = 1024*1024*1024
+        case strings.HasSuffix(value, "T"): multiplier = 1024*1024*1024*1024
+    }
+    if multiplier > 1 { value = value[:len(value)-1] }
+    bytes, err = strconv.ParseInt(value, 10, 64)
+    if err != nil || bytes < 0 { return 0, 0, badMinFree }
+    return bytes*multiplier, 0, nil
+}
+
+// parseFsync accepts always, rotate, never or sync interval (200ms)
+func parseFsync(value string)(mode string, interval time.Duration, err error){
+    switch value {
+        case fsyncAlways, fsyncRotate, fsyncNever:
+            return value, 0, nil
+    }
+    interval, err = time.ParseDuration(value)
+    if err != nil || interval <= 0 { return "", 0, badFsync }
+    return fsyncInterval, interval, nil
+}
+
+func diskFree(path string)(free uint64, total uint64, err error){
+    var stat syscall.Statfs_t
+    err = syscall.Statfs(path, &stat)
+    if err != nil { return }
+    // Bavail - blocks available to unprivileged user, that's what matters for other services
+    free  = stat.Bavail * uint64(stat.Bsize)
+    total = stat.Blocks * uint64(stat.Bsize)
+    return
+}
+
 func checkDeviceExist(device_name string)(exist bool){
     devices, err := pcap.FindAllDevs()
     if err != nil {
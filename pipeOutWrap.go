@@ -1,10 +1,80 @@
 package main
 
 // Usage:  /scripts/pipeOutWrap -cmd="/usr/sbin/tcpdump -i lo" -count=20 -log-dir="/scripts/logs" -log-dir-threshold=40
-// cmd - command which is going to be wrapped
-// count - number of lines inside each output file
+//         /scripts/pipeOutWrap -count=20 -log-dir="/scripts/logs" -- /usr/sbin/tcpdump -i lo 'tcp port 22'
+// cmd - command which is going to be wrapped, split with POSIX shell quoting rules (no variable expansion)
+// -- - everything after it is taken as argv of command literally (instead of -cmd)
+// count - number of lines inside each output file (0 - unlimited, then rotate-interval is required)
+// rotate-interval - close current file after this interval (e.g. 5m, 1h), whichever of count/rotate-interval is hit first
+// max-file-size - close current file before it grows over this size (e.g. 512K, 10M, 1G), combinable with count/rotate-interval
+// rotate-align - align rotate-interval to local wall-clock boundaries counted from local midnight (1h gives one file per hour, 24h - one per day)
+// timestamp - prefix each line with its receive time: none, rfc3339nano, unixms (epoch seconds with ms), monotonic (offset since cmd start)
+// restart-max - how many times cmd is restarted after exit (0 - never, -1 - unlimited), wrapper stops when budget is exhausted
+// restart-backoff - delay before first restart, doubled after each restart up to restart-backoff-max
+// SIGHUP - close current file(s) immediately, next line goes to new file; cmd keeps running
+// stop-signal - signal sent to cmd when wrapper is stopped by SIGINT/SIGTERM/SIGQUIT (default - the received one), e.g. INT makes tcpdump print its stats
+// stop-grace - how long to wait for cmd after stop-signal before SIGKILL
+// stderr - what to do with stderr of cmd: none (drop), separate (own <cmd>.stderr.logfile.<ts> series), merge (into main files, each line is tagged with its stream)
 // log-dir - path to directory with output files
-// log-dir-threshold - max size of log directory in Mb (script is automatically removes old files)
+// log-dir-threshold - max size of log directory in Mb (script is automatically removes old files), 0 - no size limit
+// max-age - remove files which were not modified longer than this (e.g. 72h)
+// max-files - keep at most this number of files
+// only wrapper's own files (<cmd>.[stderr.]logfile.<ts>[.N][.gz] directly inside log-dir) are counted and removed
+// cleanup-interval - how often retention is checked besides each rotation; old files are removed until all limits are met
+// min-free - keep at least this much free space on log-dir filesystem (e.g. 2G or 10%), old files are removed to get it;
+//            if nothing more can be removed, lines are dropped (with a warning) until space is available again
+// compress - gzip each finished file in background to <name>.gz (original is removed after gzip is written)
+// manifest - keep <cmd>.index.jsonl in log-dir with one entry per finished file (name, first/last line time, lines, size, compression, sha256),
+//            entries of removed files are dropped from it
+// active file is written as <name>.partial and renamed when it's finished; log-dir/current (current.stderr for stderr series)
+// is a symlink to active file, so "tail -F current" follows rotations
+// format - text (raw lines) or json: one object per line {"ts","host","cmd","pid","stream","seq","line"},
+//          timestamp/stderr tags are not added to json lines, lines with invalid UTF-8 also get "line_base64" with original bytes
+// fsync - when written lines are synced to disk: always (after each line), <duration> (e.g. 200ms, at most this long after a line),
+//         rotate (when file is closed) or never (left to OS); lines are written through a buffer which goes to the file
+//         when no more lines are waiting (so followers see them right away) and always when file is closed
+// buffer - how many lines may wait between reading from cmd and writing to file (per series)
+// backpressure - what to do when buffer is full: block (stop reading, cmd blocks on its stdout and e.g. tcpdump drops packets),
+//                drop-newest (drop line just read) or drop-oldest (drop longest waiting line); dropped lines are counted and
+//                "--- N lines dropped ... ---" marker line is written to the file before the next written line
+// exclude - drop lines matching regex, include - drop lines not matching regex,
+// redact - replace text of regex capture groups (whole match if regex has no groups) with redact-mask, e.g. -redact='Authorization: \S+ (\S+)'
+// exclude/include/redact may be repeated, rules are applied in command line order to each line (also stderr) before it's written,
+// line dropped by a rule isn't seen by next rules; each rule counts lines it dropped/changed (printed on exit and in metrics)
+// syslog - also send each line (after rules, without timestamp/json formatting) to syslog as RFC 5424 message:
+//          udp://host:514, tcp://host:601 (octet counting framing) or unix:///dev/log; MSGID is the stream (stdout/stderr), PROCID is pid of cmd
+// syslog-facility - kern, user, mail, daemon, auth, syslog, lpr, news, uucp, cron, authpriv, ftp, local0..local7
+// syslog-severity - emerg, alert, crit, err, warning, notice, info, debug
+// syslog-app-name - APP-NAME of messages, default is cmd name
+// syslog is best effort: lines are queued and dropped (and counted) while destination is down or slow, files aren't affected
+// push-url - also POST lines to this HTTP endpoint as gzipped NDJSON batches (Content-Encoding: gzip, Content-Type: application/x-ndjson);
+//            with -format=json lines are sent as they are, otherwise each line is {"host","cmd","file","offset","line"}
+// push-header - "Name: value" added to each request (e.g. -push-header="Authorization: Bearer ..."), may be repeated
+// push-batch - maximum lines in one request, push-backoff-max - failed request is retried with doubling delay up to this
+// files in log-dir are the buffer: position of last accepted line is kept in <cmd>.push.json in log-dir, so after
+// collector outage or wrapper restart pushing continues from there (lines may be sent twice, never skipped, unless
+// retention removes the file before it's pushed - this is reported as lost file)
+// metrics-listen - address (e.g. :9101) of HTTP endpoint with Prometheus metrics at /metrics
+//
+// Several commands: /scripts/pipeOutWrap -config=/etc/pipeOutWrap.conf -log-dir="/scripts/logs" -count=1000 -total-threshold=10G
+// config - file with one command per line: its own flags and command (-cmd="..." or -- argv), e.g.
+//              -name=lo -log-dir-threshold=40 -- /usr/sbin/tcpdump -l -i lo
+//              -rotate-interval=1h -cmd="/usr/bin/journalctl -f"
+//          empty lines and lines starting with # are skipped; flags given on command line are defaults for all lines;
+//          each command is supervised, rotated and cleaned up on its own and writes to <log-dir>/<name>/ (created if missing);
+//          SIGINT/SIGTERM/SIGQUIT stop all commands, SIGHUP rotates files of all commands, wrapper exits when all of them are stopped
+// name - name of command (its log subdirectory and cmd label of metrics), default is cmd base name, must be unique
+// total-threshold - optional limit of size of files of all commands together (e.g. 10G), oldest file of any command is removed first;
+//                   metrics-listen and total-threshold are taken from command line only
+//
+// Query:  /scripts/pipeOutWrap query -log-dir="/scripts/logs" -since="2024-05-01 14:00" -until=30m -grep="tcp port 22"
+// prints matching lines as <file>:<line number>:<line>, files are picked by their name timestamps (and manifest if present),
+// plain and .gz files are read transparently; since/until - RFC3339, "2006-01-02 15:04[:05]", "15:04[:05]" (today) or duration back from now;
+// cmd - only files of this command; exit code is 1 if nothing matched (like grep)
+//
+// Follow: /scripts/pipeOutWrap follow -log-dir="/scripts/logs" -cmd=tcpdump -n=20
+// prints new lines as they are written, moving to next file on each rotation (also after wrapper restart);
+// n - print last n lines first, series - "stderr" to follow stderr series, interval - how often log-dir is polled
 //
 
 import "fmt"
@@ -18,103 +88,675 @@ import "strings"
 import "io"
 import "bufio"
 import "path/filepath"
+import "compress/gzip"
+import "sync"
+import "syscall"
+import "regexp"
+import "sync/atomic"
+import "strconv"
+import "hash"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "sort"
+import "net/http"
+import "unicode/utf8"
+import "encoding/base64"
+import "net"
+import "net/url"
+import "context"
 //
 
 var cmdIsEmpty      = errors.New("cmd is empty")
+var cmdTwice        = errors.New("use either -cmd or -- command, not both")
+var unterminatedQuote = errors.New("cmd has unterminated quote")
+var badSignal       = errors.New("unknown signal name")
+var badTime         = errors.New("bad time value")
+var badFormat       = errors.New("format should be one of: text, json")
+var cmdAndConfig    = errors.New("use either -config or a command, not both")
+var nameTwice       = errors.New("name is used by another command, set unique -name")
+var badName         = errors.New("name should be a plain directory name: not empty, \".\", \"..\" and without path separator")
+var badFsync        = errors.New("fsync should be one of: always, rotate, never or a duration (e.g. 200ms)")
+var badBackpressure = errors.New("backpressure should be one of: block, drop-newest, drop-oldest")
+var badRule         = errors.New("bad filter rule regex")
+var badSyslog       = errors.New("syslog should be udp://host:port, tcp://host:port or unix:///path")
+var badFacility     = errors.New("unknown syslog facility")
+var badSeverity     = errors.New("unknown syslog severity")
+var badHeader       = errors.New("header should be \"Name: value\"")
+var badMinFree      = errors.New("min-free should be a size (e.g. 2G) or a percentage (e.g. 10%)")
 var countTooShort   = errors.New("count to short")
 var parseError      = errors.New("parse error")
 var cantOpenNewFile = errors.New("can't open new file")
 var fileDoesntExist = errors.New("file doesn't exist")
 var logDirNotExists = errors.New("log-dir doesn't exist")
+var badSize         = errors.New("bad size value")
+var badStderrMode   = errors.New("stderr should be one of: none, separate, merge")
+var badTimestamp    = errors.New("timestamp should be one of: none, rfc3339nano, unixms, monotonic")
+
+const partialSuffix = ".partial"
+
+const (
+    formatText     = "text"
+    formatJSON     = "json"
+)
+
+var syslogFacilities = map[string]int{
+    "kern":0, "user":1, "mail":2, "daemon":3, "auth":4, "syslog":5, "lpr":6, "news":7,
+    "uucp":8, "cron":9, "authpriv":10, "ftp":11,
+    "local0":16, "local1":17, "local2":18, "local3":19, "local4":20, "local5":21, "local6":22, "local7":23,
+}
+
+var syslogSeverities = map[string]int{
+    "emerg":0, "alert":1, "crit":2, "err":3, "warning":4, "notice":5, "info":6, "debug":7,
+}
+
+const (
+    fsyncAlways    = "always"
+    fsyncInterval  = "interval"
+    fsyncRotate    = "rotate"
+    fsyncNever     = "never"
+)
+
+const (
+    backpressureBlock      = "block"
+    backpressureDropNewest = "drop-newest"
+    backpressureDropOldest = "drop-oldest"
+)
+
+const (
+    ruleExclude    = "exclude"
+    ruleInclude    = "include"
+    ruleRedact     = "redact"
+)
+
+const (
+    stderrNone     = "none"
+    stderrSeparate = "separate"
+    stderrMerge    = "merge"
+)
+
+const (
+    timestampNone        = "none"
+    timestampRFC3339Nano = "rfc3339nano"
+    timestampUnixMs      = "unixms"
+    timestampMonotonic   = "monotonic"
+)
+
+// logFile is an inventory entry of a file inside log_dir
+type logFile struct {
+    name               string
+    size               int64
+    mtime              time.Time
+}
+
+// fileStats is collected while file is written and goes to manifest when file is closed
+type fileStats struct {
+    series             string
+    first              time.Time
+    last               time.Time
+    records            int
+    hash               hash.Hash
+}
+
+// manifestEntry is a single line of <cmd>.index.jsonl
+type manifestEntry struct {
+    File               string    `json:"file"`
+    Series             string    `json:"series,omitempty"`
+    First              time.Time `json:"first"`
+    Last               time.Time `json:"last"`
+    Lines              int       `json:"lines"`
+    Size               int64     `json:"size"`
+    Compression        string    `json:"compression"`
+    Sha256             string    `json:"sha256"`
+}
+
+// rotatedFile is a file found in log_dir, its properties are parsed from the name
+type rotatedFile struct {
+    path               string
+    cmd                string
+    series             string
+    start              time.Time
+    seq                int
+    // end of the covered time range, from manifest (zero if unknown)
+    first              time.Time
+    last               time.Time
+}
+
+type streamMetrics struct {
+    lines              int64
+    bytes              int64
+}
+
+// runnerMetrics are exposed at -metrics-listen, counters are updated with sync/atomic
+type runnerMetrics struct {
+    // keys are fixed at start ("stdout", "stderr"), so map itself is read only
+    received           map[string]*streamMetrics
+    filesRotated       int64
+    filesDeleted       int64
+    writeErrors        int64
+    restarts           int64
+    exits              map[string]int64
+    // lines dropped by backpressure policy, by stream
+    dropped            map[string]*int64
+    exitsMu            sync.Mutex
+}
+
+// filterRule is applied to each line between capture and handle
+type filterRule struct {
+    action             string
+    re                 *regexp.Regexp
+    // lines dropped (exclude/include) or changed (redact) by this rule, updated with sync/atomic
+    matched            int64
+}
+
+// ruleFlag appends rule of its action to shared list, so order of rules is the order of flags
+type ruleFlag struct {
+    action             string
+    rules              *[]*filterRule
+}
+
+func (f ruleFlag)String()(string){
+    return ""
+}
+
+func (f ruleFlag)Set(value string)(error){
+    re, err := regexp.Compile(value)
+    if err != nil { return fmt.Errorf("%v: %v", badRule, err) }
+    *f.rules = append(*f.rules, &filterRule{action:f.action, re:re})
+    return nil
+}
+
+// headerFlag collects repeated "Name: value" flags
+type headerFlag struct {
+    header             http.Header
+}
+
+func (f headerFlag)String()(string){
+    return ""
+}
+
+func (f headerFlag)Set(value string)(error){
+    i := strings.Index(value, ":")
+    if i < 1 { return badHeader }
+    f.header.Add(strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:]))
+    return nil
+}
+
+// Line is a single line received from one of the child's streams
+type Line struct {
+    stream             string
+    text               string
+    received           time.Time
+    pid                int
+    // start of the process which printed line, -timestamp=monotonic offsets are counted from it
+    started            time.Time
+    // sequence number of line among all streams of the runner
+    seq                uint64
+}
+
+// jsonLine is written for each line with -format=json
+type jsonLine struct {
+    Ts                 time.Time `json:"ts"`
+    Host               string    `json:"host"`
+    Cmd                string    `json:"cmd"`
+    Pid                int       `json:"pid"`
+    Stream             string    `json:"stream"`
+    Seq                uint64    `json:"seq"`
+    Line               string    `json:"line"`
+    LineBase64         string    `json:"line_base64,omitempty"`
+}
+
+type Config struct {
+
+    cmd                []string
+    log_dir            string
+    log_dir_threshold  int
+    count              int
+    compress           bool
+    rotate_interval    time.Duration
+    rotate_align       bool
+    max_file_size      int64
+    stderr_mode        string
+    timestamp          string
+    restart_max        int
+    restart_backoff    time.Duration
+    restart_backoff_max time.Duration
+    stop_signal        syscall.Signal
+    stop_grace         time.Duration
+    max_age            time.Duration
+    max_files          int
+    cleanup_interval   time.Duration
+    min_free_bytes     int64
+    min_free_percent   float64
+    manifest           bool
+    metrics_listen     string
+    format             string
+    rules              []*filterRule
+    redact_mask        string
+    syslog             string
+    syslog_facility    int
+    syslog_severity    int
+    syslog_app_name    string
+    push_url           string
+    push_header        http.Header
+    push_batch         int
+    push_backoff_max   time.Duration
+    buffer             int
+    backpressure       string
+    fsync              string
+    fsync_interval     time.Duration
+    config             string
+    name               string
+    total_threshold    int64
+
+}
 
 type Runner struct {
 
     cmd                *exec.Cmd
+    cmd_line           []string
+    // name of command, label of its metrics
+    name               string
     log_dir            string
     log_dir_threshold  int
+    // shared by all commands of the process, nil if there is no total-threshold
+    budget             *diskBudget
     stdout             io.ReadCloser
-    ch                 chan string
-    quitCapture        chan bool
-    quitHandle         chan bool
+    stderr             io.ReadCloser
+    ch                 chan Line
+    errCh              chan Line
+    // cancelled when wrapper is asked to stop
+    ctx                context.Context
+    cancel             context.CancelFunc
     quit               chan bool
     count              int
     compress           bool
-    currentLogFile     string
-    timeout_sec        time.Duration
+    rotate_interval    time.Duration
+    rotate_align       bool
+    max_file_size      int64
+    stderr_mode        string
+    timestamp          string
+    // written by supervise on each (re)start, read by capture for lines of the new process
+    started            time.Time
+    startedMu          sync.Mutex
+    restart_max        int
+    restart_backoff    time.Duration
+    restart_backoff_max time.Duration
+    restarts           int
+    stop_signal        syscall.Signal
+    stop_grace         time.Duration
+    received_signal    os.Signal
+    rotateChans        []chan bool
+    max_age            time.Duration
+    max_files          int
+    own_pattern        *regexp.Regexp
+    cleanup_interval   time.Duration
+    cleanUpRequest     chan bool
+    quitJanitor        chan bool
+    janitorDone        chan bool
+    inventory          map[string]*logFile
+    inventoryMu        sync.Mutex
+    // file chosen by total-threshold to be removed by janitor of this runner, guarded by inventoryMu
+    budgetVictim       string
+    min_free_bytes     int64
+    min_free_percent   float64
+    paused             int32
+    pausedDropped      int64
+    manifest           string
+    manifestMu         sync.Mutex
+    metrics_listen     string
+    metrics            runnerMetrics
+    format             string
+    hostname           string
+    seq                uint64
+    rules              []*filterRule
+    redact_mask        string
+    syslog             *syslogWriter
+    pusher             *pusher
+    backpressure       string
+    fsync              string
+    fsync_interval     time.Duration
+    // lines dropped by backpressure policy for each channel and not reported in file yet, map is read only
+    droppedPending     map[chan Line]*int64
+    lastExit           string
+    currentLogFiles    map[string]string
+    currentMu          sync.Mutex
+    captureWg          sync.WaitGroup
+    handleWg           sync.WaitGroup
+    compressing        map[string]bool
+    compressingMu      sync.Mutex
+    compressWg         sync.WaitGroup
 
 }
 
 func main() {
 
-    cmd_line,logDir,count,logDirThreshold,compress,err := parseInput()
-    //fmt.Printf("Flags:\n%v %v %v %v\n",cmd_line,logDir,count,compress)
+    if len(os.Args) > 1 && os.Args[1] == "query" {
+        os.Exit(query(os.Args[2:]))
+    }
+    if len(os.Args) > 1 && os.Args[1] == "follow" {
+        os.Exit(follow(os.Args[2:]))
+    }
 
-    if err != nil { fmt.Printf("error:%v\n",err) ; return }
+    cfgs,err := parseInput()
+    //fmt.Printf("Flags:\n%v\n",cfgs)
 
-    runner,err := NewRunner(cmd_line,logDir,count,logDirThreshold,compress)
     if err != nil { fmt.Printf("error:%v\n",err) ; return }
 
-    runner.run()
+    var runners []*Runner
+    for _, cfg := range cfgs {
+        runner,err := NewRunner(cfg)
+        if err != nil { fmt.Printf("error:%v: %v\n",cfg.name,err) ; return }
+        runners = append(runners, runner)
+    }
+    if cfgs[0].total_threshold > 0 {
+        // runners join budget when they are started
+        budget := &diskBudget{limit:cfgs[0].total_threshold, stopped:make(map[*Runner]bool)}
+        for _, runner := range runners { runner.budget = budget }
+    }
+
+    runAll(runners, cfgs[0].metrics_listen)
 }
 
-func parseInput()(cmd []string, logDir string, count int, log_dir_threshold int, compress bool,  err error){
+// parseArgs parses flags of one command, Config isn't validated
+func parseArgs(name string, handling flag.ErrorHandling, args []string)(cfg Config, err error){
 
     var cmdLine string
+    flags              := flag.NewFlagSet(name, handling)
 
-    cmdLinePtr         := flag.String("cmd","","Command to run")
-    logDirPtr          := flag.String("log-dir","./","Path to log directory")
-    countPtr           := flag.Int("count",0,"Lines count")
-    logDirThresholdPtr := flag.Int("log-dir-threshold",100,"Maximum log directory size MB")
-    compressPtr        := flag.Bool("compress",false,"Compress")
+    cmdLinePtr         := flags.String("cmd","","Command to run")
+    logDirPtr          := flags.String("log-dir","./","Path to log directory")
+    countPtr           := flags.Int("count",0,"Lines count")
+    logDirThresholdPtr := flags.Int("log-dir-threshold",100,"Maximum log directory size MB")
+    compressPtr        := flags.Bool("compress",false,"Compress")
+    rotateIntervalPtr  := flags.Duration("rotate-interval",0,"Rotate file after this interval (e.g. 5m, 1h)")
+    rotateAlignPtr     := flags.Bool("rotate-align",false,"Align interval rotation to wall-clock boundaries")
+    maxFileSizePtr     := flags.String("max-file-size","","Maximum size of each file (e.g. 512K, 10M, 1G)")
+    stderrModePtr      := flags.String("stderr",stderrNone,"Stderr handling: none, separate, merge")
+    timestampPtr       := flags.String("timestamp",timestampNone,"Line timestamp: none, rfc3339nano, unixms, monotonic")
+    restartMaxPtr      := flags.Int("restart-max",0,"Maximum number of cmd restarts (0 - never, -1 - unlimited)")
+    restartBackoffPtr  := flags.Duration("restart-backoff",time.Second,"Delay before first restart")
+    restartBackoffMaxPtr := flags.Duration("restart-backoff-max",time.Minute,"Maximum delay between restarts")
+    stopSignalPtr      := flags.String("stop-signal","","Signal forwarded to cmd on stop (INT, TERM, QUIT, HUP, USR1, USR2), default is the received one")
+    stopGracePtr       := flags.Duration("stop-grace",5*time.Second,"Time given to cmd to exit after stop-signal before SIGKILL")
+    maxAgePtr          := flags.Duration("max-age",0,"Remove files older than this (e.g. 72h), 0 - no limit")
+    maxFilesPtr        := flags.Int("max-files",0,"Maximum number of files in log directory, 0 - no limit")
+    cleanupIntervalPtr := flags.Duration("cleanup-interval",time.Minute,"How often retention limits are checked")
+    minFreePtr         := flags.String("min-free","","Minimum free space on log-dir filesystem (e.g. 2G or 10%)")
+    manifestPtr        := flags.Bool("manifest",true,"Keep <cmd>.index.jsonl manifest of finished files")
+    metricsListenPtr   := flags.String("metrics-listen","","Address of Prometheus metrics endpoint (e.g. :9101)")
+    configPtr          := flags.String("config","","File with one command per line (flags and -- argv), flags given here are defaults for all of them")
+    namePtr            := flags.String("name","","Name of command (log subdirectory and metrics label), default is cmd base name")
+    totalThresholdPtr  := flags.String("total-threshold","","Maximum size of files of all commands together (e.g. 10G)")
+    formatPtr          := flags.String("format",formatText,"Output format: text, json")
+    fsyncPtr           := flags.String("fsync",fsyncAlways,"When lines are synced to disk: always, <duration>, rotate, never")
+    bufferPtr          := flags.Int("buffer",100,"Lines waiting to be written, per series")
+    backpressurePtr    := flags.String("backpressure",backpressureBlock,"When buffer is full: block, drop-newest, drop-oldest")
+    syslogPtr          := flags.String("syslog","","Syslog destination: udp://host:port, tcp://host:port, unix:///dev/log")
+    syslogFacilityPtr  := flags.String("syslog-facility","user","Syslog facility")
+    syslogSeverityPtr  := flags.String("syslog-severity","info","Syslog severity")
+    syslogAppNamePtr   := flags.String("syslog-app-name","","Syslog APP-NAME, default is cmd name")
+    pushURLPtr         := flags.String("push-url","","HTTP endpoint receiving gzipped NDJSON batches of lines")
+    pushBatchPtr       := flags.Int("push-batch",1000,"Maximum lines in one push request")
+    pushBackoffMaxPtr  := flags.Duration("push-backoff-max",time.Minute,"Maximum delay between push retries")
+    cfg.push_header     = make(http.Header)
+    flags.Var(headerFlag{cfg.push_header}, "push-header", "Header of push requests, \"Name: value\" (repeatable)")
+    redactMaskPtr      := flags.String("redact-mask","***","Replacement of text matched by redact rules")
+    flags.Var(ruleFlag{ruleExclude, &cfg.rules}, "exclude", "Drop lines matching regex (repeatable)")
+    flags.Var(ruleFlag{ruleInclude, &cfg.rules}, "include", "Drop lines not matching regex (repeatable)")
+    flags.Var(ruleFlag{ruleRedact,  &cfg.rules}, "redact", "Mask capture groups (or whole match) of regex (repeatable)")
 
-    flag.Parse()
+    err = flags.Parse(args)
+    if err != nil { return }
 
-    if cmdLinePtr         != nil {  cmdLine           = *cmdLinePtr         } else { err = parseError ; return }
-    if logDirPtr          != nil {  logDir            = *logDirPtr          } else { err = parseError ; return }
-    if countPtr           != nil {  count             = *countPtr           } else { err = parseError ; return }
-    if logDirThresholdPtr != nil {  log_dir_threshold = *logDirThresholdPtr } else { err = parseError ; return }
-    if compressPtr        != nil {  compress          = *compressPtr        } else { err = parseError ; return }
+    if cmdLinePtr         != nil {  cmdLine               = *cmdLinePtr         } else { err = parseError ; return }
+    if logDirPtr          != nil {  cfg.log_dir           = *logDirPtr          } else { err = parseError ; return }
+    if countPtr           != nil {  cfg.count             = *countPtr           } else { err = parseError ; return }
+    if logDirThresholdPtr != nil {  cfg.log_dir_threshold = *logDirThresholdPtr } else { err = parseError ; return }
+    if compressPtr        != nil {  cfg.compress          = *compressPtr        } else { err = parseError ; return }
+    if rotateIntervalPtr  != nil {  cfg.rotate_interval   = *rotateIntervalPtr  } else { err = parseError ; return }
+    if rotateAlignPtr     != nil {  cfg.rotate_align      = *rotateAlignPtr     } else { err = parseError ; return }
+    if maxFileSizePtr     != nil {  cfg.max_file_size,err = parseSize(*maxFileSizePtr) ; if err != nil { return } } else { err = parseError ; return }
+    if stderrModePtr      != nil {  cfg.stderr_mode       = *stderrModePtr      } else { err = parseError ; return }
+    if timestampPtr       != nil {  cfg.timestamp         = *timestampPtr       } else { err = parseError ; return }
+    if restartMaxPtr      != nil {  cfg.restart_max       = *restartMaxPtr      } else { err = parseError ; return }
+    if restartBackoffPtr  != nil {  cfg.restart_backoff   = *restartBackoffPtr  } else { err = parseError ; return }
+    if restartBackoffMaxPtr != nil { cfg.restart_backoff_max = *restartBackoffMaxPtr } else { err = parseError ; return }
+    if stopSignalPtr      != nil {  cfg.stop_signal,err   = parseSignal(*stopSignalPtr) ; if err != nil { return } } else { err = parseError ; return }
+    if stopGracePtr       != nil {  cfg.stop_grace        = *stopGracePtr       } else { err = parseError ; return }
+    if maxAgePtr          != nil {  cfg.max_age           = *maxAgePtr          } else { err = parseError ; return }
+    if maxFilesPtr        != nil {  cfg.max_files         = *maxFilesPtr        } else { err = parseError ; return }
+    if cleanupIntervalPtr != nil {  cfg.cleanup_interval  = *cleanupIntervalPtr } else { err = parseError ; return }
+    if minFreePtr         != nil {  cfg.min_free_bytes,cfg.min_free_percent,err = parseMinFree(*minFreePtr) ; if err != nil { return } } else { err = parseError ; return }
+    if manifestPtr        != nil {  cfg.manifest          = *manifestPtr        } else { err = parseError ; return }
+    if metricsListenPtr   != nil {  cfg.metrics_listen    = *metricsListenPtr   } else { err = parseError ; return }
+    if configPtr          != nil {  cfg.config            = *configPtr          } else { err = parseError ; return }
+    if namePtr            != nil {  cfg.name              = *namePtr            } else { err = parseError ; return }
+    if totalThresholdPtr  != nil {  cfg.total_threshold,err = parseSize(*totalThresholdPtr) ; if err != nil { return } } else { err = parseError ; return }
+    if formatPtr          != nil {  cfg.format            = *formatPtr          } else { err = parseError ; return }
+    if fsyncPtr           != nil {  cfg.fsync,cfg.fsync_interval,err = parseFsync(*fsyncPtr) ; if err != nil { return } } else { err = parseError ; return }
+    if bufferPtr          != nil {  cfg.buffer            = *bufferPtr          } else { err = parseError ; return }
+    if backpressurePtr    != nil {  cfg.backpressure      = *backpressurePtr    } else { err = parseError ; return }
+    if redactMaskPtr      != nil {  cfg.redact_mask       = *redactMaskPtr      } else { err = parseError ; return }
+    if syslogPtr          != nil {  cfg.syslog            = *syslogPtr          } else { err = parseError ; return }
+    if pushURLPtr         != nil {  cfg.push_url          = *pushURLPtr         } else { err = parseError ; return }
+    if pushBatchPtr       != nil {  cfg.push_batch        = *pushBatchPtr       } else { err = parseError ; return }
+    if pushBackoffMaxPtr  != nil {  cfg.push_backoff_max  = *pushBackoffMaxPtr  } else { err = parseError ; return }
+    if syslogAppNamePtr   != nil {  cfg.syslog_app_name   = *syslogAppNamePtr   } else { err = parseError ; return }
+    if syslogFacilityPtr  != nil {
+        var ok bool
+        cfg.syslog_facility, ok = syslogFacilities[strings.ToLower(*syslogFacilityPtr)]
+        if !ok { err = badFacility ; return }
+    } else { err = parseError ; return }
+    if syslogSeverityPtr  != nil {
+        var ok bool
+        cfg.syslog_severity, ok = syslogSeverities[strings.ToLower(*syslogSeverityPtr)]
+        if !ok { err = badSeverity ; return }
+    } else { err = parseError ; return }
 
-    if cmdLine == "" { err = cmdIsEmpty  ; return }
-    if count   < 1 { err = countTooShort ; return }
-
-    cmd   = strings.Split(cmdLine," ")
+    if cmdLine != "" && flags.NArg() > 0 { err = cmdTwice ; return }
+    if flags.NArg() > 0 {
+        cfg.cmd = flags.Args()
+    } else if cmdLine != "" {
+        cfg.cmd,err = splitCommandLine(cmdLine)
+        if err != nil { return }
+    }
+    if cfg.name == "" && len(cfg.cmd) > 0 { cfg.name = filepath.Base(cfg.cmd[0]) }
 
     return
 
 }
 
-func NewRunner( cmd_line []string, log_dir string, count int, log_dir_threshold int, compress bool )( *Runner , error){
+func (cfg *Config)validate()(error){
+    if len(cfg.cmd) == 0 { return cmdIsEmpty }
+    // name is a subdirectory of log-dir with -config
+    if cfg.name == "" || cfg.name == "." || cfg.name == ".." || strings.ContainsRune(cfg.name, filepath.Separator) { return badName }
+    switch cfg.stderr_mode {
+        case stderrNone, stderrSeparate, stderrMerge:
+        default: return badStderrMode
+    }
+    switch cfg.format {
+        case formatText, formatJSON:
+        default: return badFormat
+    }
+    switch cfg.backpressure {
+        case backpressureBlock, backpressureDropNewest, backpressureDropOldest:
+        default: return badBackpressure
+    }
+    if cfg.buffer < 1 { return parseError }
+    switch cfg.timestamp {
+        case timestampNone, timestampRFC3339Nano, timestampUnixMs, timestampMonotonic:
+        default: return badTimestamp
+    }
+    if cfg.count < 0 || cfg.rotate_interval < 0 { return parseError }
+    if cfg.max_age < 0 || cfg.max_files < 0 || cfg.log_dir_threshold < 0 { return parseError }
+    if cfg.cleanup_interval <= 0 { return parseError }
+    if cfg.push_batch < 1 || cfg.push_backoff_max < time.Second { return parseError }
+    if cfg.restart_backoff < 0 || cfg.restart_backoff_max < cfg.restart_backoff { return parseError }
+    // at least one rotation limit is required
+    if cfg.count < 1 && cfg.rotate_interval == 0 && cfg.max_file_size == 0 { return countTooShort }
+    return nil
+
+}
+
+func parseInput()(cfgs []Config, err error){
+
+    cfg, err := parseArgs(os.Args[0], flag.ExitOnError, os.Args[1:])
+    if err != nil { return }
+    if cfg.config == "" {
+        err = cfg.validate()
+        if err != nil { return }
+        return []Config{cfg}, nil
+    }
+    if len(cfg.cmd) > 0 { err = cmdAndConfig ; return }
+    data, err := os.ReadFile(cfg.config)
+    if err != nil { return }
+    names := make(map[string]bool)
+    for n, line := range strings.Split(string(data), "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") { continue }
+        var lineArgs []string
+        var c Config
+        lineArgs, err = splitCommandLine(line)
+        // flags of command line go first, so flags of the line override them
+        if err == nil { c, err = parseArgs(cfg.config, flag.ContinueOnError, append(append([]string{}, os.Args[1:]...), lineArgs...)) }
+        if err == nil { err = c.validate() }
+        if err == nil && names[c.name] { err = nameTwice }
+        if err != nil { err = fmt.Errorf("%v:%v: %v", cfg.config, n+1, err) ; return }
+        names[c.name] = true
+        // these belong to the whole process
+        c.metrics_listen  = cfg.metrics_listen
+        c.total_threshold = cfg.total_threshold
+        // each command gets own subdirectory
+        c.log_dir         = filepath.Join(c.log_dir, c.name)
+        cfgs = append(cfgs, c)
+    }
+    if len(cfgs) == 0 { err = cmdIsEmpty ; return }
+    // directories are created only when whole config is valid
+    for _, c := range cfgs {
+        err = os.Mkdir(c.log_dir, 0755)
+        if err != nil && !os.IsExist(err) { return }
+    }
+    return cfgs, nil
+
+}
+
+func NewRunner( cfg Config )( *Runner , error){
 
     var r Runner
-    cmd,err       := Command(cmd_line)
+    cmd,err       := Command(cfg.cmd)
     if err != nil { return nil,err }
     r.cmd         =  cmd
+    r.cmd_line    =  cfg.cmd
+    r.name        =  cfg.name
+    log_dir       := cfg.log_dir
     if !strings.HasSuffix(log_dir, "/") { log_dir=log_dir+"/" }
     r.log_dir           = log_dir
     //
     _, err = os.Stat(r.log_dir)
     if os.IsNotExist(err) { return nil, logDirNotExists }
     //
-    r.ch                = make(chan string,100)
-    r.quitCapture       = make(chan bool)
-    r.quitHandle        = make(chan bool)
+    r.ch                = make(chan Line,cfg.buffer)
+    r.errCh             = make(chan Line,cfg.buffer)
+    r.backpressure      = cfg.backpressure
+    r.fsync             = cfg.fsync
+    r.fsync_interval    = cfg.fsync_interval
+    r.droppedPending    = map[chan Line]*int64{r.ch:new(int64), r.errCh:new(int64)}
+    r.ctx, r.cancel     = context.WithCancel(context.Background())
     r.quit              = make(chan bool)
-    r.count             = count
-    r.log_dir_threshold = log_dir_threshold
-    r.compress          = compress
-    r.timeout_sec       = 2
+    r.count             = cfg.count
+    r.log_dir_threshold = cfg.log_dir_threshold
+    r.compress          = cfg.compress
+    r.rotate_interval   = cfg.rotate_interval
+    r.rotate_align      = cfg.rotate_align
+    r.max_file_size     = cfg.max_file_size
+    r.stderr_mode       = cfg.stderr_mode
+    r.timestamp         = cfg.timestamp
+    r.restart_max       = cfg.restart_max
+    r.restart_backoff   = cfg.restart_backoff
+    r.restart_backoff_max = cfg.restart_backoff_max
+    r.stop_signal       = cfg.stop_signal
+    r.stop_grace        = cfg.stop_grace
+    r.max_age           = cfg.max_age
+    r.max_files         = cfg.max_files
+    r.own_pattern       = ownFilePattern(filepath.Base(cfg.cmd[0]))
+    r.cleanup_interval  = cfg.cleanup_interval
+    r.min_free_bytes    = cfg.min_free_bytes
+    r.min_free_percent  = cfg.min_free_percent
+    if cfg.manifest { r.manifest = r.log_dir + filepath.Base(cfg.cmd[0]) + ".index.jsonl" }
+    r.metrics_listen    = cfg.metrics_listen
+    r.format            = cfg.format
+    r.hostname,_        = os.Hostname()
+    r.rules             = cfg.rules
+    r.redact_mask       = cfg.redact_mask
+    if cfg.syslog != "" {
+        appName := cfg.syslog_app_name
+        if appName == "" { appName = filepath.Base(cfg.cmd[0]) }
+        r.syslog, err = newSyslogWriter(cfg.syslog, cfg.syslog_facility, cfg.syslog_severity, appName, r.hostname)
+        if err != nil { return nil, err }
+    }
+    r.metrics.received  = map[string]*streamMetrics{"stdout":&streamMetrics{}, "stderr":&streamMetrics{}}
+    r.metrics.exits     = make(map[string]int64)
+    r.metrics.dropped   = map[string]*int64{"stdout":new(int64), "stderr":new(int64)}
+    r.cleanUpRequest    = make(chan bool, 1)
+    r.quitJanitor       = make(chan bool)
+    r.janitorDone       = make(chan bool)
+    // directory is scanned once, then inventory is kept up to date by the wrapper itself
+    r.inventory         = make(map[string]*logFile)
+    files, err         := ownFiles(r.log_dir, r.own_pattern)
+    if err != nil { return nil, err }
+    for _, info := range files {
+        r.inventoryPut(r.log_dir+info.Name(), info.Size(), info.ModTime())
+    }
+    r.currentLogFiles   = make(map[string]string)
+    r.compressing       = make(map[string]bool)
+    if cfg.push_url != "" {
+        series := []string{""}
+        if r.stderr_mode == stderrSeparate { series = append(series, "stderr") }
+        r.pusher, err = newPusher(cfg, r.log_dir, r.hostname, series)
+        if err != nil { return nil, err }
+    }
     fmt.Printf("runner:\n")
-    fmt.Printf("\n\tcmd_line:%v",cmd_line)
+    fmt.Printf("\n\tname:%v",r.name)
+    fmt.Printf("\n\tcmd_line:%v",cfg.cmd)
     fmt.Printf("\n\tlog_dir:%v",r.log_dir)
     fmt.Printf("\n\tch:%v",r.ch)
-    fmt.Printf("\n\tquitCapture:%v",r.quitCapture)
-    fmt.Printf("\n\tquitHandle:%v",r.quitHandle)
+    fmt.Printf("\n\tbuffer:%v",cap(r.ch))
+    fmt.Printf("\n\tbackpressure:%v",r.backpressure)
+    fmt.Printf("\n\tfsync:%v %v",r.fsync,r.fsync_interval)
     fmt.Printf("\n\tquit:%v",r.quit)
     fmt.Printf("\n\tcount:%v",r.count)
     fmt.Printf("\n\tlog_dir_threshold:%v",r.log_dir_threshold)
     fmt.Printf("\n\tcompress:%v",r.compress)
-    fmt.Printf("\n\ttimeout_sec:%v",r.timeout_sec)
+    fmt.Printf("\n\trotate_interval:%v",r.rotate_interval)
+    fmt.Printf("\n\trotate_align:%v",r.rotate_align)
+    fmt.Printf("\n\tmax_file_size:%v",r.max_file_size)
+    fmt.Printf("\n\tstderr_mode:%v",r.stderr_mode)
+    fmt.Printf("\n\ttimestamp:%v",r.timestamp)
+    fmt.Printf("\n\trestart_max:%v",r.restart_max)
+    fmt.Printf("\n\trestart_backoff:%v",r.restart_backoff)
+    fmt.Printf("\n\trestart_backoff_max:%v",r.restart_backoff_max)
+    fmt.Printf("\n\tstop_signal:%v",r.stop_signal)
+    fmt.Printf("\n\tstop_grace:%v",r.stop_grace)
+    fmt.Printf("\n\tmax_age:%v",r.max_age)
+    fmt.Printf("\n\tmax_files:%v",r.max_files)
+    fmt.Printf("\n\tcleanup_interval:%v",r.cleanup_interval)
+    fmt.Printf("\n\tmin_free_bytes:%v",r.min_free_bytes)
+    fmt.Printf("\n\tmin_free_percent:%v",r.min_free_percent)
+    fmt.Printf("\n\tmanifest:%v",r.manifest)
+    fmt.Printf("\n\tmetrics_listen:%v",r.metrics_listen)
+    fmt.Printf("\n\tformat:%v",r.format)
+    for i, rule := range r.rules {
+        fmt.Printf("\n\trule %v:%v %v",i,rule.action,rule.re)
+    }
+    fmt.Printf("\n\tredact_mask:%v",r.redact_mask)
+    if r.syslog != nil {
+        fmt.Printf("\n\tsyslog:%v://%v facility:%v severity:%v app_name:%v",r.syslog.network,r.syslog.address,r.syslog.facility,r.syslog.severity,r.syslog.app_name)
+    }
+    if r.pusher != nil {
+        fmt.Printf("\n\tpush_url:%v batch:%v backoff_max:%v checkpoint:%v",r.pusher.url,r.pusher.batch,r.pusher.backoff_max,r.pusher.checkpointPath)
+    }
+    fmt.Printf("\n\tinventory:%v files",len(r.inventory))
     fmt.Printf("\n")
     return &r, nil
 
@@ -122,143 +764,1477 @@ func NewRunner( cmd_line []string, log_dir string, count int, log_dir_threshold
 
 func (r *Runner)run()(error){
 
+    err := r.start()
+    if err != nil { return err }
+    r.startHandle(r.ch, "")
+    if r.stderr_mode == stderrSeparate {
+        r.startHandle(r.errCh, "stderr")
+    }
+    go r.janitor()
+    if r.syslog != nil { go r.syslog.run() }
+    if r.pusher != nil { go r.pusher.run() }
+    go r.supervise()
+    return nil
+
+}
+
+// runAll runs all commands and returns when all of them are stopped
+func runAll(runners []*Runner, metricsListen string)(){
+    var started []*Runner
+    for _, r := range runners {
+        err := r.run()
+        if err != nil { fmt.Printf("\nunable to start %v: %v",r.name,err) ; continue }
+        if r.budget != nil { r.budget.join(r) }
+        started = append(started, r)
+    }
+    if len(started) == 0 { return }
+    if metricsListen != "" { go serveMetrics(metricsListen, started) }
+    catchExit(started)
+}
+
+func (r *Runner)startHandle(ch chan Line, series string)(){
+    rotate := make(chan bool, 1)
+    r.rotateChans = append(r.rotateChans, rotate)
+    r.handleWg.Add(1)
+    go r.handle(ch, series, rotate)
+}
+
+// start launches new instance of cmd and its capture goroutines
+func (r *Runner)start()(error){
+
+    if r.cmd == nil {
+        cmd, err := Command(r.cmd_line)
+        if err != nil { return err }
+        r.cmd = cmd
+    }
     stdout, err := r.cmd.StdoutPipe()
     if err != nil { return err }
     r.stdout = stdout
+    if r.stderr_mode != stderrNone {
+        stderr, err := r.cmd.StderrPipe()
+        if err != nil { return err }
+        r.stderr = stderr
+    }
     err = r.cmd.Start()
     if err != nil { return err }
-    go r.capture()
-    go r.handle()
-    r.catchExit()
+    r.startedMu.Lock()
+    r.started = time.Now()
+    r.startedMu.Unlock()
+    r.captureWg.Add(1)
+    go r.capture(r.stdout, "stdout", r.ch)
+    switch r.stderr_mode {
+        case stderrMerge:
+            r.captureWg.Add(1)
+            go r.capture(r.stderr, "stderr", r.ch)
+        case stderrSeparate:
+            r.captureWg.Add(1)
+            go r.capture(r.stderr, "stderr", r.errCh)
+    }
     return nil
 
 }
 
-func(r *Runner)catchExit()(){
+// supervise waits for cmd to exit and restarts it with exponential backoff
+// until restart budget is exhausted or quit is requested
+func (r *Runner)supervise()(){
 
-    signalChan  := make(chan os.Signal, 1)
-    cleanupDone := make(chan bool)
-    signal.Notify(signalChan, os.Interrupt)
-    signal.Notify(signalChan, os.Kill)
-    go func() {
-        for _ = range signalChan {
-            r.quitCapture <- true
-            <-r.quit
-            cleanupDone <- true
+    backoff := r.restart_backoff
+    for {
+        exited := make(chan bool)
+        go func() {
+            // Wait must be called only after all reads from pipes are done
+            r.captureWg.Wait()
+            r.lastExit = exitStatus(r.cmd.Wait())
+            r.metrics.exitsMu.Lock()
+            r.metrics.exits[r.lastExit] += 1
+            r.metrics.exitsMu.Unlock()
+            close(exited)
+        }()
+        stopping := false
+        select {
+            case <-exited:
+            case <-r.ctx.Done():
+                stopping = true
+                r.stopCmd(exited)
+        }
+        fmt.Printf("\ncmd %v exited: %v (pid %v, uptime %v)",r.cmd_line,r.lastExit,r.cmd.Process.Pid,time.Since(r.startedAt()))
+        if stopping { break }
+        if r.restart_max >= 0 && r.restarts >= r.restart_max {
+            fmt.Printf("\nrestart budget is exhausted (%v restarts), stopping",r.restarts)
             break
         }
-    }()
-    <-cleanupDone
-    return
+        if time.Since(r.startedAt()) > r.restart_backoff_max {
+            // cmd was running long enough, it's not a crash loop
+            backoff = r.restart_backoff
+        }
+        fmt.Printf("\nrestarting cmd in %v",backoff)
+        select {
+            case <-time.After(backoff):
+            case <-r.ctx.Done():
+                stopping = true
+        }
+        if stopping { break }
+        backoff *= 2
+        if backoff > r.restart_backoff_max { backoff = r.restart_backoff_max }
+        r.restarts += 1
+        atomic.AddInt64(&r.metrics.restarts, 1)
+        r.cmd = nil
+        err := r.start()
+        if err != nil {
+            fmt.Printf("\nunable to restart cmd: %v",err)
+            break
+        }
+    }
+    // no more input, handles finish when channels are drained
+    close(r.ch)
+    close(r.errCh)
+    r.handleWg.Wait()
+    if r.syslog != nil { r.syslog.stop(r.stop_grace) }
+    r.compressWg.Wait()
+    // all files are final now, give pusher a chance to send the rest
+    if r.pusher != nil { r.pusher.stop(r.stop_grace) }
+    close(r.quitJanitor)
+    <-r.janitorDone
+    if dropped := atomic.LoadInt64(r.metrics.dropped["stdout"]) + atomic.LoadInt64(r.metrics.dropped["stderr"]) ; dropped > 0 {
+        fmt.Printf("\n%v lines dropped by backpressure policy",dropped)
+    }
+    for i, rule := range r.rules {
+        fmt.Printf("\nrule %v (%v %v): %v lines",i,rule.action,rule.re,atomic.LoadInt64(&rule.matched))
+    }
+    close(r.quit)
 
 }
 
+// stopCmd forwards stop signal to cmd and kills it if it is still running after grace period
+func (r *Runner)stopCmd(exited chan bool)(){
+    var sig os.Signal = r.stop_signal
+    if r.stop_signal == 0 { sig = r.received_signal }
+    if sig == nil { sig = syscall.SIGTERM }
+    fmt.Printf("\nsending %v to cmd (pid %v)",sig,r.cmd.Process.Pid)
+    r.cmd.Process.Signal(sig)
+    select {
+        case <-exited:
+        case <-time.After(r.stop_grace):
+            fmt.Printf("\ncmd is still running after %v, killing it",r.stop_grace)
+            r.cmd.Process.Kill()
+    }
+    select {
+        case <-exited:
+        case <-time.After(r.stop_grace):
+            // cmd is dead, but its children may still hold the pipes open
+            fmt.Printf("\npipes of cmd are still open, closing them")
+            r.stdout.Close()
+            if r.stderr != nil { r.stderr.Close() }
+            <-exited
+    }
+}
 
+func exitStatus(err error)(string){
+    if err == nil { return "exit code 0" }
+    if exitErr, ok := err.(*exec.ExitError); ok {
+        if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+            if ws.Signaled() { return fmt.Sprintf("signal %v", ws.Signal()) }
+            return fmt.Sprintf("exit code %v", ws.ExitStatus())
+        }
+    }
+    return err.Error()
+}
 
-func(r *Runner)capture()(){
-    //
-    // lineReader := bufio.NewReader(r.stdout)
-    exit:=false
-    lineReader := bufio.NewReader(r.stdout)
-    var deffered string
+func catchExit(runners []*Runner)(){
+
+    signalChan  := make(chan os.Signal, 1)
+    // SIGKILL can't be caught, SIGTERM is what systemd sends on stop
+    signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
+    done        := make(chan bool)
+    go func() {
+        for _, r := range runners { <-r.quit }
+        close(done)
+    }()
     for {
         select {
-            default:
-                if exit { break }
-                line,isPrefix,err := lineReader.ReadLine()
-                if isPrefix && err==nil {
-                    deffered+=string(line)
+            case sig := <-signalChan:
+                if sig == syscall.SIGHUP {
+                    fmt.Printf("\ngot %v, rotating files",sig)
+                    for _, r := range runners { r.forceRotate() }
                     continue
                 }
-                if err == nil && !isPrefix {
-                    lineStr := string(line)
-                    r.ch<-deffered+lineStr
-                    deffered = ""
+                fmt.Printf("\ngot %v, stopping",sig)
+                for _, r := range runners {
+                    r.received_signal = sig
+                    r.cancel()
                 }
-                if err!= nil { break }
-            case <- r.quitCapture:
-                exit = true
+                <-done
+                return
+            case <-done:
+                // all cmds are gone and won't be restarted
+                return
+        }
+    }
+
+}
+
+
+
+func (r *Runner)forceRotate()(){
+    for _, rotate := range r.rotateChans {
+        // rotation is already pending if channel is full
+        select {
+            case rotate<-true:
+            default:
         }
     }
-    r.cmd.Process.Kill()
-    r.quitHandle<-true
+}
+
+func(r *Runner)capture(reader io.Reader, stream string, ch chan Line)(){
+    //
+    // read until EOF even when stopping: cmd may print something (e.g. tcpdump stats) on stop signal
+    lineReader := bufio.NewReader(reader)
+    pid        := r.cmd.Process.Pid
+    // capture is started right after cmd, restart can't change it yet
+    started    := r.startedAt()
+    var deffered string
+    for {
+        line,isPrefix,err := lineReader.ReadLine()
+        if isPrefix && err==nil {
+            deffered+=string(line)
+            continue
+        }
+        if err == nil && !isPrefix {
+            lineStr := string(line)
+            text := deffered+lineStr
+            atomic.AddInt64(&r.metrics.received[stream].lines, 1)
+            atomic.AddInt64(&r.metrics.received[stream].bytes, int64(len(text)+1))
+            deffered = ""
+            text, keep := r.applyRules(text)
+            if !keep { continue }
+            r.enqueue(ch, Line{stream:stream, text:text, received:time.Now(), pid:pid, started:started, seq:atomic.AddUint64(&r.seq, 1)})
+        }
+        if err!= nil { break }
+    }
+    r.captureWg.Done()
     //
 }
 
+// enqueue passes line to handle according to backpressure policy
+func (r *Runner)enqueue(ch chan Line, line Line)(){
+    switch r.backpressure {
+        case backpressureDropNewest:
+            select {
+                case ch<-line:
+                default:
+                    r.countDropped(ch, line.stream)
+            }
+        case backpressureDropOldest:
+            for {
+                select {
+                    case ch<-line:
+                        return
+                    default:
+                }
+                // handle may take it first, then there is a room for line anyway
+                select {
+                    case old := <-ch:
+                        r.countDropped(ch, old.stream)
+                    default:
+                }
+            }
+        default:
+            ch<-line
+    }
+}
+
+func (r *Runner)countDropped(ch chan Line, stream string)(){
+    atomic.AddInt64(r.droppedPending[ch], 1)
+    atomic.AddInt64(r.metrics.dropped[stream], 1)
+}
 
-func (r *Runner)handle()(){
+// dropMarker returns line written to file in place of lines dropped by backpressure policy
+func (r *Runner)dropMarker(n int64)(Line){
+    text := fmt.Sprintf("--- %v lines dropped, writer fell behind (backpressure %v, buffer %v) ---", n, r.backpressure, cap(r.ch))
+    return Line{stream:"pipeoutwrap", text:text, received:time.Now(), pid:os.Getpid()}
+}
+
+// applyRules runs line through filter rules, keep is false if line should be dropped
+func (r *Runner)applyRules(text string)(result string, keep bool){
+    for _, rule := range r.rules {
+        switch rule.action {
+            case ruleExclude:
+                if rule.re.MatchString(text) { atomic.AddInt64(&rule.matched, 1) ; return "", false }
+            case ruleInclude:
+                if !rule.re.MatchString(text) { atomic.AddInt64(&rule.matched, 1) ; return "", false }
+            case ruleRedact:
+                redacted := redact(text, rule.re, r.redact_mask)
+                if redacted != text { atomic.AddInt64(&rule.matched, 1) ; text = redacted }
+        }
+    }
+    return text, true
+}
+
+// redact replaces capture groups of each match (or whole match if re has no groups) with mask
+func redact(text string, re *regexp.Regexp, mask string)(string){
+    matches := re.FindAllStringSubmatchIndex(text, -1)
+    if matches == nil { return text }
+    var b strings.Builder
+    last := 0
+    for _, m := range matches {
+        spans := m[:2]
+        if len(m) > 2 { spans = m[2:] }
+        for i := 0; i < len(spans); i += 2 {
+            // group didn't participate in match or overlaps previous one
+            if spans[i] < 0 || spans[i] < last { continue }
+            b.WriteString(text[last:spans[i]])
+            b.WriteString(mask)
+            last = spans[i+1]
+        }
+    }
+    b.WriteString(text[last:])
+    return b.String()
+}
+
+// series - suffix added after cmd name to file names ("" for main files)
+// rotate - close current file right now (SIGHUP)
+// handle returns when ch is closed and drained
+func (r *Runner)handle(ch chan Line, series string, rotate chan bool)(){
     //
-    finish := false
     var f *os.File
+    var w *bufio.Writer
     var err error
     var logName string
     //
-    blank              := true
-    counter            := 0
+    var stats          fileStats
+    var written        int64
+    // fires when rotate-interval of current file is passed, nil channel if there is no such limit
+    var rotateTimer    *time.Timer
+    var rotateC        <-chan time.Time
+    // fires fsync interval after first unsynced line
+    var syncTimer      *time.Timer
+    var syncC          <-chan time.Time
+    closeFile := func(){
+        if f != nil { r.closeLogFile(f, w, stats) ; f = nil }
+        if rotateTimer != nil { rotateTimer.Stop() ; rotateTimer = nil ; rotateC = nil }
+        if syncTimer != nil { syncTimer.Stop() ; syncTimer = nil ; syncC = nil }
+    }
     //
+    loop:
     for {
         select {
-            case s, ok := <-r.ch:
+            case line, ok := <-ch:
                     if !ok {
+                        break loop
+                    }
+                    // syslog doesn't depend on local disk, send even when files are paused
+                    if r.syslog != nil { r.syslog.send(line) }
+                    if r.isPaused() {
+                        // disk is full and nothing can be removed
+                        atomic.AddInt64(&r.pausedDropped, 1)
+                        r.requestCleanUp()
                         break
                     }
-                    if blank {
+                    s := r.formatLine(line)
+                    records := 1
+                    if n := atomic.SwapInt64(r.droppedPending[ch], 0) ; n > 0 {
+                        marker  := r.dropMarker(n)
+                        marker.started = line.started
+                        s        = r.formatLine(marker) + "\n" + s
+                        records += 1
+                    }
+                    if f != nil && r.max_file_size > 0 && written > 0 && written+int64(len(s)+1) > r.max_file_size {
+                        // line doesn't fit into current file
+                        closeFile()
+                    }
+                    if f == nil {
                         // prepare new filename
-                        if f!=nil      { f.Sync()  ; f.Close()  ; f = nil     }
-                        counter     =  0
+                        stats       =  fileStats{series:series, hash:sha256.New()}
+                        written     =  0
                         t           := time.Now()
                         timestamp   := t.Format("20060102150405")
                         logName     =  "logfile."+timestamp
-                        if len(r.cmd.Args) > 0 {
-                            cmdName := filepath.Base(r.cmd.Args[0])
+                        if series != "" { logName = series + "." + logName }
+                        if len(r.cmd_line) > 0 {
+                            cmdName := filepath.Base(r.cmd_line[0])
                             logName = cmdName + "." + logName
                         }
                         //fmt.Printf("\ncreate file: %v\n",r.log_dir + logName)
-                        new_file := r.log_dir + logName
+                        // file gets its final name only when it's closed
+                        new_file := r.uniqueLogName(r.log_dir + logName) + partialSuffix
                         f, err = os.Create(new_file)
-                        if err != nil { break }
-                        blank = false
-                        r.currentLogFile = new_file
-                        go r.cleanUp()
+                        if err != nil { atomic.AddInt64(&r.metrics.writeErrors, 1) ; f = nil ; break }
+                        w = bufio.NewWriterSize(f, 64*1024)
+                        r.setCurrentLogFile(series, new_file)
+                        r.updateCurrentLink(series, new_file)
+                        if rotateAt := r.nextRotation(t) ; !rotateAt.IsZero() {
+                            rotateTimer = time.NewTimer(time.Until(rotateAt))
+                            rotateC     = rotateTimer.C
+                        }
+                        r.inventoryPut(new_file, 0, t)
+                        r.requestCleanUp()
                     }
-                    _,err = f.WriteString(s+"\n")
-                    f.Sync()
-                    counter += 1
-                    if (counter >= r.count) || ( err!= nil )  { blank = true }
+                    var n int
+                    n,err = w.WriteString(s+"\n")
+                    if err == nil { err = r.flushRecord(f, w, len(ch) > 0) }
+                    if err != nil { atomic.AddInt64(&r.metrics.writeErrors, 1) }
+                    if r.fsync == fsyncInterval && syncTimer == nil {
+                        syncTimer = time.NewTimer(r.fsync_interval)
+                        syncC     = syncTimer.C
+                    }
+                    stats.hash.Write([]byte(s+"\n")[:n])
+                    if stats.records == 0 { stats.first = line.received }
+                    stats.last     = line.received
+                    stats.records += records
+                    written       += int64(n)
+                    if w.Buffered() == 0 {
+                        // everything is in the file, retention and metrics should see its real size
+                        r.inventoryResize(f.Name(), written)
+                        if r.pusher != nil { r.pusher.notify() }
+                    }
+                    if (r.count > 0 && stats.records >= r.count) || ( err!= nil )  { closeFile() }
+                    if r.max_file_size > 0 && written >= r.max_file_size { closeFile() }
                     //fmt.Println(s)
-            case <-r.quitHandle:
-                finish = true
-            default:
-                if finish { break }
-                time.Sleep(time.Second * r.timeout_sec)
+            case <-syncC:
+                syncTimer, syncC = nil, nil
+                if f != nil {
+                    err = w.Flush()
+                    if err == nil { err = f.Sync() }
+                    if err != nil { atomic.AddInt64(&r.metrics.writeErrors, 1) }
+                    r.inventoryResize(f.Name(), written)
+                }
+            case <-rotateC:
+                // interval is passed, close current file even if there are no new lines
+                closeFile()
+            case <-rotate:
+                closeFile()
         }
     }
-    if f!=nil      { f.Sync() ;  f.Close() ; f = nil }
-    r.quit<-true
+    closeFile()
+    r.setCurrentLogFile(series, "")
+    r.updateCurrentLink(series, "")
+    r.handleWg.Done()
+}
+
+func (r *Runner)setCurrentLogFile(series string, name string)(){
+    r.currentMu.Lock()
+    defer r.currentMu.Unlock()
+    if name == "" { delete(r.currentLogFiles, series) ; return }
+    r.currentLogFiles[series] = filepath.Clean(name)
+}
+
+// updateCurrentLink points log_dir/current (current.<series>) to active file, empty name removes the link
+func (r *Runner)updateCurrentLink(series string, name string)(){
+    link := r.log_dir + "current"
+    if series != "" { link = link + "." + series }
+    if name == "" { os.Remove(link) ; return }
+    // symlink is replaced atomically with rename, relative target keeps it valid if log_dir is moved
+    tmpLink := link + ".tmp"
+    os.Remove(tmpLink)
+    err := os.Symlink(filepath.Base(name), tmpLink)
+    if err == nil { err = os.Rename(tmpLink, link) }
+    if err != nil { fmt.Printf("\nUnable to update %v: %v",link,err) }
+}
+
+func (r *Runner)isCurrentLogFile(name string)(bool){
+    r.currentMu.Lock()
+    defer r.currentMu.Unlock()
+    for _, current := range r.currentLogFiles {
+        if current == filepath.Clean(name) { return true }
+    }
+    return false
+}
+
+func (r *Runner)formatLine(line Line)(string){
+    if r.format == formatJSON { return r.formatJSONLine(line) }
+    s := line.text
+    if r.stderr_mode == stderrMerge { s = "["+line.stream+"] "+s }
+    switch r.timestamp {
+        case timestampRFC3339Nano:
+            s = line.received.Format(time.RFC3339Nano)+" "+s
+        case timestampUnixMs:
+            ms := line.received.UnixNano() / int64(time.Millisecond)
+            s = fmt.Sprintf("%d.%03d %s", ms/1000, ms%1000, s)
+        case timestampMonotonic:
+            // time.Now() carries monotonic clock reading, so wall clock jumps don't affect the offset;
+            // lines of previous process may still be waiting after restart, so its own start is used
+            s = fmt.Sprintf("+%.6f %s", line.received.Sub(line.started).Seconds(), s)
+    }
+    return s
+}
+
+func (r *Runner)formatJSONLine(line Line)(string){
+    obj := jsonLine{
+        Ts:     line.received,
+        Host:   r.hostname,
+        Cmd:    filepath.Base(r.cmd_line[0]),
+        Pid:    line.pid,
+        Stream: line.stream,
+        Seq:    line.seq,
+        Line:   line.text,
+    }
+    if !utf8.ValidString(line.text) {
+        // json.Marshal would silently replace invalid bytes with U+FFFD, keep original bytes too
+        obj.Line       = strings.ToValidUTF8(line.text, "\uFFFD")
+        obj.LineBase64 = base64.StdEncoding.EncodeToString([]byte(line.text))
+    }
+    data, err := json.Marshal(obj)
+    if err != nil { return line.text }
+    return string(data)
+}
+
+func (r *Runner)startedAt()(time.Time){
+    r.startedMu.Lock()
+    defer r.startedMu.Unlock()
+    return r.started
+}
+
+func (r *Runner)nextRotation(opened time.Time)(time.Time){
+    if r.rotate_interval <= 0 { return time.Time{} }
+    if r.rotate_align {
+        // Truncate would round relative to UTC zero time, count boundaries from local midnight instead
+        y, m, d  := opened.Date()
+        midnight := time.Date(y, m, d, 0, 0, 0, 0, opened.Location())
+        next     := midnight.Add(opened.Sub(midnight).Truncate(r.rotate_interval) + r.rotate_interval)
+        // interval which doesn't divide a day still starts over at next midnight
+        if tomorrow := midnight.AddDate(0, 0, 1) ; next.After(tomorrow) { next = tomorrow }
+        return next
+    }
+    return opened.Add(r.rotate_interval)
+}
+
+// flushRecord is called after each line written to w, pending tells that more lines are waiting in channel
+func (r *Runner)flushRecord(f *os.File, w *bufio.Writer, pending bool)(err error){
+    if r.fsync == fsyncAlways {
+        err = w.Flush()
+        if err == nil { err = f.Sync() }
+        return
+    }
+    // under load lines go to file in big chunks, otherwise they are visible to readers right away
+    if !pending { err = w.Flush() }
+    return
+}
+
+func (r *Runner)closeLogFile(f *os.File, w *bufio.Writer, stats fileStats)(){
+    //
+    partialName := f.Name()
+    if err := w.Flush() ; err != nil {
+        fmt.Printf("\nUnable to write %v: %v",partialName,err)
+        atomic.AddInt64(&r.metrics.writeErrors, 1)
+    }
+    if r.fsync != fsyncNever { f.Sync() }
+    f.Close()
+    name := strings.TrimSuffix(partialName, partialSuffix)
+    r.inventoryRemove(partialName)
+    if err := os.Rename(partialName, name) ; err != nil {
+        fmt.Printf("\nUnable to rename %v: %v",partialName,err)
+        atomic.AddInt64(&r.metrics.writeErrors, 1)
+        name = partialName
+    }
+    atomic.AddInt64(&r.metrics.filesRotated, 1)
+    entry := manifestEntry{
+        File:        filepath.Base(name),
+        Series:      stats.series,
+        First:       stats.first,
+        Last:        stats.last,
+        Lines:       stats.records,
+        Compression: "none",
+        Sha256:      hex.EncodeToString(stats.hash.Sum(nil)),
+    }
+    if info, err := os.Stat(name) ; err == nil {
+        r.inventoryPut(name, info.Size(), info.ModTime())
+        entry.Size = info.Size()
+    }
+    if !r.compress { r.manifestAppend(entry) }
+    if r.compress {
+        r.compressingMu.Lock()
+        r.compressing[filepath.Clean(name)] = true
+        r.compressingMu.Unlock()
+        r.compressWg.Add(1)
+        go func() {
+            defer r.compressWg.Done()
+            sum, err := compressFile(name)
+            if err != nil { fmt.Printf("\nUnable to compress file %v: %v",name,err) }
+            if info, serr := os.Stat(name+".gz") ; err == nil && serr == nil {
+                r.inventoryRemove(name)
+                r.inventoryPut(name+".gz", info.Size(), info.ModTime())
+                entry.File        = filepath.Base(name+".gz")
+                entry.Size        = info.Size()
+                entry.Compression = "gzip"
+                entry.Sha256      = sum
+            }
+            r.manifestAppend(entry)
+            r.compressingMu.Lock()
+            delete(r.compressing, filepath.Clean(name))
+            r.compressingMu.Unlock()
+        }()
+    }
+    //
+}
+
+func (r *Runner)uniqueLogName(name string)(string){
+    // several files may be opened within one second, don't overwrite file (or its .gz/.partial) which is already there
+    candidate := name
+    for i := 1 ; ; i++ {
+        _, err        := os.Stat(candidate)
+        _, gzErr      := os.Stat(candidate+".gz")
+        _, partialErr := os.Stat(candidate+partialSuffix)
+        if os.IsNotExist(err) && os.IsNotExist(gzErr) && os.IsNotExist(partialErr) && !r.isCompressing(candidate) { return candidate }
+        candidate = fmt.Sprintf("%v.%v",name,i)
+    }
 }
 
+func (r *Runner)isCompressing(name string)(bool){
+    r.compressingMu.Lock()
+    defer r.compressingMu.Unlock()
+    return r.compressing[filepath.Clean(name)]
+}
+
+// lowDiskSpace reports whether free space on log_dir filesystem is below min-free
+func (r *Runner)lowDiskSpace()(bool){
+    if r.min_free_bytes == 0 && r.min_free_percent == 0 { return false }
+    free, total, err := diskFree(r.log_dir)
+    if err != nil { fmt.Printf("\nUnable to statfs %v: %v",r.log_dir,err) ; return false }
+    if r.min_free_bytes > 0 && free < uint64(r.min_free_bytes) { return true }
+    if r.min_free_percent > 0 && total > 0 && float64(free)*100/float64(total) < r.min_free_percent { return true }
+    return false
+}
+
+// updatePause stops writing when disk is still low after cleanUp had nothing more to remove
+func (r *Runner)updatePause()(){
+    low := r.lowDiskSpace()
+    if low && atomic.CompareAndSwapInt32(&r.paused, 0, 1) {
+        fmt.Printf("\n!!! WARNING: free space on %v is below min-free and there is nothing more to remove, capture is PAUSED, lines are dropped !!!",r.log_dir)
+    }
+    if !low && atomic.CompareAndSwapInt32(&r.paused, 1, 0) {
+        fmt.Printf("\nfree space on %v is available again, capture is resumed (%v lines were dropped)",r.log_dir,atomic.SwapInt64(&r.pausedDropped, 0))
+    }
+}
+
+func (r *Runner)isPaused()(bool){
+    return atomic.LoadInt32(&r.paused) == 1
+}
+
+func (r *Runner)manifestAppend(entry manifestEntry)(){
+    if r.manifest == "" { return }
+    r.manifestMu.Lock()
+    defer r.manifestMu.Unlock()
+    data, err := json.Marshal(entry)
+    if err != nil { return }
+    f, err := os.OpenFile(r.manifest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil { fmt.Printf("\nUnable to open manifest %v: %v",r.manifest,err) ; return }
+    defer f.Close()
+    _, err = f.Write(append(data, '\n'))
+    if err != nil { fmt.Printf("\nUnable to write manifest %v: %v",r.manifest,err) }
+}
+
+// manifestRemove drops entries of removed files, manifest is rewritten via temporary file and rename
+func (r *Runner)manifestRemove(files []string)(){
+    if r.manifest == "" || len(files) == 0 { return }
+    r.manifestMu.Lock()
+    defer r.manifestMu.Unlock()
+    gone := make(map[string]bool)
+    for _, name := range files { gone[name] = true }
+    src, err := os.Open(r.manifest)
+    if err != nil { return }
+    defer src.Close()
+    tmpName := r.manifest + ".tmp"
+    dst, err := os.Create(tmpName)
+    if err != nil { fmt.Printf("\nUnable to rewrite manifest %v: %v",r.manifest,err) ; return }
+    scanner := bufio.NewScanner(src)
+    scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+    for scanner.Scan() {
+        var entry manifestEntry
+        // broken lines are kept as they are
+        if json.Unmarshal(scanner.Bytes(), &entry) == nil && gone[entry.File] { continue }
+        dst.Write(append(scanner.Bytes(), '\n'))
+    }
+    err = scanner.Err()
+    if err == nil { err = dst.Sync() }
+    if cerr := dst.Close() ; err == nil { err = cerr }
+    if err == nil { err = os.Rename(tmpName, r.manifest) }
+    if err != nil { os.Remove(tmpName) ; fmt.Printf("\nUnable to rewrite manifest %v: %v",r.manifest,err) }
+}
+
+func (r *Runner)inventoryPut(name string, size int64, mtime time.Time)(){
+    r.inventoryMu.Lock()
+    defer r.inventoryMu.Unlock()
+    name = filepath.Clean(name)
+    r.inventory[name] = &logFile{name:name, size:size, mtime:mtime}
+    // every created, renamed or compressed file passes here
+    if r.pusher != nil { r.pusher.filesChanged() }
+}
+
+// inventoryResize updates size of active file while it grows
+func (r *Runner)inventoryResize(name string, size int64)(){
+    r.inventoryMu.Lock()
+    defer r.inventoryMu.Unlock()
+    if file, ok := r.inventory[filepath.Clean(name)] ; ok { file.size = size }
+}
+
+func (r *Runner)inventoryRemove(name string)(){
+    r.inventoryMu.Lock()
+    defer r.inventoryMu.Unlock()
+    delete(r.inventory, filepath.Clean(name))
+    if r.pusher != nil { r.pusher.filesChanged() }
+}
+
+// requestCleanUp wakes up janitor, requests are coalesced if janitor is busy
+func (r *Runner)requestCleanUp()(){
+    select {
+        case r.cleanUpRequest<-true:
+        default:
+    }
+}
+
+// janitor is the only goroutine which removes files, so concurrent cleanups can't race on the same file
+func (r *Runner)janitor()(){
+    ticker := time.NewTicker(r.cleanup_interval)
+    defer ticker.Stop()
+    for {
+        select {
+            case <-r.cleanUpRequest:
+            case <-ticker.C:
+            case <-r.quitJanitor:
+                r.cleanUp()
+                // total-threshold may hand over more files while they are being removed
+                for len(r.cleanUpRequest) > 0 {
+                    <-r.cleanUpRequest
+                    r.cleanUp()
+                }
+                if r.budget != nil { r.budget.janitorStopped(r) }
+                close(r.janitorDone)
+                return
+        }
+        r.cleanUp()
+    }
+}
+
+func serveMetrics(address string, runners []*Runner)(){
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request){
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+        writeMetrics(w, runners)
+    })
+    err := http.ListenAndServe(address, mux)
+    // capture keeps working without metrics
+    fmt.Printf("\nmetrics endpoint %v failed: %v",address,err)
+}
+
+// metricsWriter groups samples of all runners by family, family header is written once
+type metricsWriter struct {
+    order              []string
+    header             map[string]string
+    samples            map[string][]string
+}
+
+// add adds sample, labels are in Prometheus format without braces (e.g. `cmd="tcpdump"`)
+func (m *metricsWriter)add(name string, kind string, help string, labels string, value interface{})(){
+    if _, ok := m.header[name] ; !ok {
+        m.order        = append(m.order, name)
+        m.header[name] = fmt.Sprintf("# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+    }
+    if labels != "" { labels = "{" + labels + "}" }
+    m.samples[name] = append(m.samples[name], fmt.Sprintf("%v%v %v\n", name, labels, value))
+}
+
+// promLabel quotes label value, exposition format escapes only backslash, double quote and newline (unlike %q)
+func promLabel(value string)(string){
+    return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+// writeMetrics writes metrics of runners in Prometheus text exposition format
+func writeMetrics(w io.Writer, runners []*Runner)(){
+    m := &metricsWriter{header:make(map[string]string), samples:make(map[string][]string)}
+    for _, r := range runners { r.collectMetrics(m) }
+    if len(runners) > 0 && runners[0].budget != nil {
+        m.add("pipeoutwrap_total_threshold_bytes", "gauge", "Configured total-threshold shared by all commands.", "", runners[0].budget.limit)
+    }
+    for _, name := range m.order {
+        io.WriteString(w, m.header[name])
+        for _, sample := range m.samples[name] { io.WriteString(w, sample) }
+    }
+}
+
+func (r *Runner)collectMetrics(m *metricsWriter)(){
+    cmd := "cmd=" + promLabel(r.name)
+    metric := func(name string, kind string, help string, value interface{}){
+        m.add(name, kind, help, cmd, value)
+    }
+    for _, stream := range []string{"stdout", "stderr"} {
+        m.add("pipeoutwrap_lines_received_total", "counter", "Lines received from cmd.", cmd + ",stream=" + promLabel(stream), atomic.LoadInt64(&r.metrics.received[stream].lines))
+    }
+    for _, stream := range []string{"stdout", "stderr"} {
+        m.add("pipeoutwrap_bytes_received_total", "counter", "Bytes received from cmd.", cmd + ",stream=" + promLabel(stream), atomic.LoadInt64(&r.metrics.received[stream].bytes))
+    }
+    _, totalSize, count := r.oldestFile()
+    metric("pipeoutwrap_files_rotated_total", "counter", "Files closed and renamed to final name.", atomic.LoadInt64(&r.metrics.filesRotated))
+    metric("pipeoutwrap_files_deleted_total", "counter", "Files removed by retention.", atomic.LoadInt64(&r.metrics.filesDeleted))
+    metric("pipeoutwrap_log_dir_files", "gauge", "Wrapper's files in log-dir.", count)
+    metric("pipeoutwrap_log_dir_size_bytes", "gauge", "Size of wrapper's files in log-dir.", totalSize)
+    metric("pipeoutwrap_log_dir_threshold_bytes", "gauge", "Configured log-dir-threshold, 0 - no limit.", int64(r.log_dir_threshold)*1024*1024)
+    m.add("pipeoutwrap_channel_depth", "gauge", "Lines waiting to be written.", cmd+`,channel="main"`, len(r.ch))
+    m.add("pipeoutwrap_channel_depth", "gauge", "Lines waiting to be written.", cmd+`,channel="stderr"`, len(r.errCh))
+    for _, stream := range []string{"stdout", "stderr"} {
+        m.add("pipeoutwrap_lines_dropped_total", "counter", "Lines dropped by backpressure policy.", cmd + ",stream=" + promLabel(stream), atomic.LoadInt64(r.metrics.dropped[stream]))
+    }
+    metric("pipeoutwrap_channel_capacity", "gauge", "Capacity of line channels.", cap(r.ch))
+    metric("pipeoutwrap_child_restarts_total", "counter", "Restarts of cmd.", atomic.LoadInt64(&r.metrics.restarts))
+    r.metrics.exitsMu.Lock()
+    statuses := make([]string, 0, len(r.metrics.exits))
+    for status := range r.metrics.exits { statuses = append(statuses, status) }
+    sort.Strings(statuses)
+    for _, status := range statuses {
+        m.add("pipeoutwrap_child_exits_total", "counter", "Exits of cmd by status.", cmd + ",status=" + promLabel(status), r.metrics.exits[status])
+    }
+    r.metrics.exitsMu.Unlock()
+    metric("pipeoutwrap_write_errors_total", "counter", "Errors creating, writing or renaming files.", atomic.LoadInt64(&r.metrics.writeErrors))
+    metric("pipeoutwrap_paused", "gauge", "1 if capture is paused because of min-free.", atomic.LoadInt32(&r.paused))
+    if r.syslog != nil {
+        metric("pipeoutwrap_syslog_sent_total", "counter", "Lines sent to syslog.", atomic.LoadInt64(&r.syslog.sent))
+        metric("pipeoutwrap_syslog_dropped_total", "counter", "Lines not sent to syslog (destination down or queue full).", atomic.LoadInt64(&r.syslog.dropped))
+        metric("pipeoutwrap_syslog_errors_total", "counter", "Syslog connect and write errors.", atomic.LoadInt64(&r.syslog.errors))
+    }
+    if r.pusher != nil {
+        metric("pipeoutwrap_push_lines_total", "counter", "Lines accepted by push-url.", atomic.LoadInt64(&r.pusher.sent))
+        metric("pipeoutwrap_push_errors_total", "counter", "Failed push requests.", atomic.LoadInt64(&r.pusher.errors))
+        metric("pipeoutwrap_push_lost_files_total", "counter", "Files removed by retention before they were pushed.", atomic.LoadInt64(&r.pusher.lost))
+    }
+    for i, rule := range r.rules {
+        m.add("pipeoutwrap_rule_lines_total", "counter", "Lines dropped (exclude, include) or changed (redact) by filter rule.",
+            fmt.Sprintf("%v,rule=\"%d\",action=%v,regex=%v", cmd, i, promLabel(rule.action), promLabel(rule.re.String())), atomic.LoadInt64(&rule.matched))
+    }
+}
+
+// syslogWriter sends lines to syslog from its own goroutine, so slow or unavailable destination doesn't block handle
+type syslogWriter struct {
+    network            string
+    address            string
+    facility           int
+    severity           int
+    app_name           string
+    hostname           string
+    queue              chan Line
+    done               chan bool
+    conn               net.Conn
+    // unix stream socket, messages are terminated with newline
+    unixStream         bool
+    // counters are updated with sync/atomic
+    sent               int64
+    dropped            int64
+    errors             int64
+}
+
+func newSyslogWriter(target string, facility int, severity int, appName string, hostname string)(*syslogWriter, error){
+    u, err := url.Parse(target)
+    if err != nil { return nil, badSyslog }
+    w := &syslogWriter{facility:facility, severity:severity, hostname:hostname}
+    switch u.Scheme {
+        case "udp", "tcp":
+            if u.Host == "" { return nil, badSyslog }
+            w.network, w.address = u.Scheme, u.Host
+        case "unix":
+            if u.Path == "" { return nil, badSyslog }
+            w.network, w.address = u.Scheme, u.Path
+        default:
+            return nil, badSyslog
+    }
+    // APP-NAME is up to 48 printable characters without spaces
+    w.app_name = strings.Map(func(c rune)(rune){
+        if c <= ' ' || c > '~' { return '_' }
+        return c
+    }, appName)
+    if len(w.app_name) > 48 { w.app_name = w.app_name[:48] }
+    if w.hostname == "" { w.hostname = "-" }
+    w.queue = make(chan Line, 1000)
+    w.done  = make(chan bool)
+    return w, nil
+}
+
+// send queues line, it's dropped if queue is full
+func (w *syslogWriter)send(line Line)(){
+    select {
+        case w.queue<-line:
+        default:
+            atomic.AddInt64(&w.dropped, 1)
+    }
+}
+
+// stop sends what is left in queue, giving up after grace
+func (w *syslogWriter)stop(grace time.Duration)(){
+    close(w.queue)
+    select {
+        case <-w.done:
+        case <-time.After(grace):
+            fmt.Printf("\nsyslog: %v lines left unsent",len(w.queue))
+    }
+}
+
+func (w *syslogWriter)run()(){
+    var retryAt time.Time
+    for line := range w.queue {
+        if w.conn == nil {
+            if time.Now().Before(retryAt) { atomic.AddInt64(&w.dropped, 1) ; continue }
+            err := w.dial()
+            if err != nil {
+                atomic.AddInt64(&w.errors, 1)
+                atomic.AddInt64(&w.dropped, 1)
+                fmt.Printf("\nsyslog %v://%v is unavailable: %v",w.network,w.address,err)
+                retryAt = time.Now().Add(5*time.Second)
+                continue
+            }
+        }
+        w.conn.SetWriteDeadline(time.Now().Add(5*time.Second))
+        _, err := w.conn.Write(w.message(line))
+        if err != nil {
+            atomic.AddInt64(&w.errors, 1)
+            atomic.AddInt64(&w.dropped, 1)
+            fmt.Printf("\nsyslog %v://%v write failed: %v",w.network,w.address,err)
+            w.conn.Close()
+            w.conn  = nil
+            retryAt = time.Now().Add(5*time.Second)
+            continue
+        }
+        atomic.AddInt64(&w.sent, 1)
+    }
+    if w.conn != nil { w.conn.Close() }
+    close(w.done)
+}
+
+func (w *syslogWriter)dial()(err error){
+    if w.network != "unix" {
+        w.conn, err = net.DialTimeout(w.network, w.address, 5*time.Second)
+        return
+    }
+    // /dev/log is usually a datagram socket
+    w.conn, err = net.DialTimeout("unixgram", w.address, 5*time.Second)
+    if err == nil { w.unixStream = false ; return }
+    w.conn, err = net.DialTimeout("unix", w.address, 5*time.Second)
+    w.unixStream = err == nil
+    return
+}
+
+// message formats line as RFC 5424 message with transport framing
+func (w *syslogWriter)message(line Line)([]byte){
+    msg := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+        w.facility*8+w.severity,
+        line.received.Format("2006-01-02T15:04:05.000000Z07:00"),
+        w.hostname, w.app_name, line.pid, line.stream, line.text)
+    switch {
+        case w.network == "tcp":
+            // RFC 6587 octet counting
+            msg = fmt.Sprintf("%d %s", len(msg), msg)
+        case w.unixStream:
+            msg += "\n"
+    }
+    return []byte(msg)
+}
+
+// pushPosition is a position of the first line not yet accepted by push-url
+type pushPosition struct {
+    // file name without .partial/.gz, so position survives rename and compression
+    File               string `json:"file"`
+    Offset             int64  `json:"offset"`
+}
+
+// pusher reads lines from files in log_dir and posts them to push-url, so collector outage doesn't block handle
+type pusher struct {
+    url                string
+    header             http.Header
+    batch              int
+    backoff_max        time.Duration
+    log_dir            string
+    cmd_name           string
+    hostname           string
+    series             []string
+    json               bool
+    client             *http.Client
+    checkpointPath     string
+    // series -> position
+    checkpoint         map[string]pushPosition
+    wake               chan bool
+    quit               chan bool
+    done               chan bool
+    // files of cmd, rescanned only when rescan is set (file is created, renamed or removed)
+    files              []rotatedFile
+    rescan             int32
+    // counters are updated with sync/atomic
+    sent               int64
+    errors             int64
+    lost               int64
+}
+
+func newPusher(cfg Config, log_dir string, hostname string, series []string)(*pusher, error){
+    p := &pusher{
+        url:            cfg.push_url,
+        header:         cfg.push_header,
+        batch:          cfg.push_batch,
+        backoff_max:    cfg.push_backoff_max,
+        log_dir:        log_dir,
+        cmd_name:       filepath.Base(cfg.cmd[0]),
+        hostname:       hostname,
+        series:         series,
+        json:           cfg.format == formatJSON,
+        client:         &http.Client{Timeout: 30*time.Second},
+        checkpoint:     make(map[string]pushPosition),
+        wake:           make(chan bool, 1),
+        quit:           make(chan bool),
+        done:           make(chan bool),
+    }
+    p.checkpointPath = log_dir + p.cmd_name + ".push.json"
+    data, err := os.ReadFile(p.checkpointPath)
+    if err == nil {
+        err = json.Unmarshal(data, &p.checkpoint)
+        if err != nil { return nil, fmt.Errorf("bad push checkpoint %v: %v", p.checkpointPath, err) }
+    } else if !os.IsNotExist(err) {
+        return nil, err
+    }
+    return p, nil
+}
+
+// filesChanged tells pusher that a file was created, renamed or removed
+func (p *pusher)filesChanged()(){
+    atomic.StoreInt32(&p.rescan, 1)
+    p.notify()
+}
+
+// notify tells pusher that files have new data
+func (p *pusher)notify()(){
+    select {
+        case p.wake<-true:
+        default:
+    }
+}
+
+// stop lets pusher send what is left, giving up after grace (checkpoint keeps the rest for the next run)
+func (p *pusher)stop(grace time.Duration)(){
+    close(p.quit)
+    select {
+        case <-p.done:
+        case <-time.After(grace):
+            fmt.Printf("\npush: not all lines were sent, will continue from checkpoint on next start")
+    }
+}
+
+func (p *pusher)run()(){
+    defer close(p.done)
+    backoff  := time.Second
+    quitting := false
+    for {
+        progressed, err := p.pushPending()
+        if err != nil {
+            atomic.AddInt64(&p.errors, 1)
+            fmt.Printf("\npush to %v failed, retry in %v: %v",p.url,backoff,err)
+            if quitting { return }
+            select {
+                case <-time.After(backoff):
+                case <-p.quit:
+                    quitting = true
+            }
+            backoff *= 2
+            if backoff > p.backoff_max { backoff = p.backoff_max }
+            continue
+        }
+        backoff = time.Second
+        if progressed { continue }
+        if quitting { return }
+        select {
+            case <-p.wake:
+            case <-p.quit:
+                quitting = true
+        }
+    }
+}
+
+// pushPending sends at most one batch of each series, progressed is false when there is nothing more to send
+func (p *pusher)pushPending()(progressed bool, err error){
+    if p.files == nil || atomic.SwapInt32(&p.rescan, 0) == 1 {
+        // manifests aren't needed here, first/last times are not used
+        p.files, err = scanRotatedFiles(p.log_dir, p.cmd_name)
+        if err != nil { return false, err }
+    }
+    for _, series := range p.series {
+        var files []rotatedFile
+        for _, file := range p.files {
+            if file.series != series { continue }
+            // plain file and its .gz exist together while it's being compressed
+            if len(files) > 0 && pushName(files[len(files)-1].path) == pushName(file.path) { continue }
+            files = append(files, file)
+        }
+        sent, err := p.pushSeries(series, files)
+        if err != nil { return progressed, err }
+        progressed = progressed || sent
+    }
+    return progressed, nil
+}
+
+func (p *pusher)pushSeries(series string, files []rotatedFile)(progressed bool, err error){
+    if len(files) == 0 { return false, nil }
+    pos   := p.checkpoint[series]
+    index := -1
+    for i, file := range files {
+        if pushName(file.path) == pos.File { index = i ; break }
+    }
+    if index < 0 {
+        // first run or file was removed, continue with the next existing one in start/seq order
+        var next *rotatedFile
+        if last, ok := parseRotatedName(pos.File) ; ok {
+            next = nextRotatedFile(files, &last)
+        } else {
+            next = &files[0]
+        }
+        if next == nil { return false, nil }
+        for i := range files {
+            if &files[i] == next { index = i }
+        }
+        if pos.File != "" {
+            atomic.AddInt64(&p.lost, 1)
+            fmt.Printf("\npush: %v was removed before it was sent completely",pos.File)
+        }
+        pos = pushPosition{File:pushName(files[index].path)}
+        return true, p.saveCheckpoint(series, pos)
+    }
+    file     := files[index]
+    finished := !strings.HasSuffix(file.path, partialSuffix)
+    lines, offsets, next, err := readPushBatch(file.path, pos.Offset, p.batch, finished)
+    if os.IsNotExist(err) {
+        // renamed or compressed in the meantime, look again
+        atomic.StoreInt32(&p.rescan, 1)
+        return true, nil
+    }
+    if err != nil { return false, err }
+    if len(lines) == 0 {
+        if !finished || index+1 == len(files) { return false, nil }
+        return true, p.saveCheckpoint(series, pushPosition{File:pushName(files[index+1].path)})
+    }
+    err = p.post(filepath.Base(pos.File), lines, offsets)
+    if err != nil { return false, err }
+    atomic.AddInt64(&p.sent, int64(len(lines)))
+    pos.Offset = next
+    return true, p.saveCheckpoint(series, pos)
+}
+
+// pushName is a name of file without directory and .partial/.gz suffix
+func pushName(path string)(string){
+    return strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), ".gz"), partialSuffix)
+}
+
+// readPushBatch reads up to max complete lines starting at offset (of uncompressed content),
+// last line without newline is taken only from finished file
+func readPushBatch(path string, offset int64, max int, finished bool)(lines []string, offsets []int64, next int64, err error){
+    f, err := openRotatedFile(path)
+    if err != nil { return }
+    defer f.Close()
+    if seeker, ok := f.(io.Seeker) ; ok {
+        _, err = seeker.Seek(offset, io.SeekStart)
+    } else {
+        // offset is in uncompressed content, gzip can't seek
+        _, err = io.CopyN(io.Discard, f, offset)
+        if err == io.EOF { return nil, nil, offset, nil }
+    }
+    if err != nil { return }
+    reader := bufio.NewReader(f)
+    next    = offset
+    size   := 0
+    for len(lines) < max && size < 1024*1024 {
+        line, rerr := reader.ReadString('\n')
+        if rerr != nil && (line == "" || !finished) { break }
+        lines   = append(lines, strings.TrimSuffix(line, "\n"))
+        offsets = append(offsets, next)
+        next   += int64(len(line))
+        size   += len(line)
+        if rerr != nil { break }
+    }
+    return lines, offsets, next, nil
+}
+
+func (p *pusher)post(file string, lines []string, offsets []int64)(error){
+    var body strings.Builder
+    zw := gzip.NewWriter(&body)
+    for i, line := range lines {
+        if p.json {
+            zw.Write([]byte(line))
+        } else {
+            data, _ := json.Marshal(struct{
+                Host   string `json:"host"`
+                Cmd    string `json:"cmd"`
+                File   string `json:"file"`
+                Offset int64  `json:"offset"`
+                Line   string `json:"line"`
+            }{p.hostname, p.cmd_name, file, offsets[i], line})
+            zw.Write(data)
+        }
+        zw.Write([]byte("\n"))
+    }
+    zw.Close()
+    req, err := http.NewRequest("POST", p.url, strings.NewReader(body.String()))
+    if err != nil { return err }
+    for name, values := range p.header {
+        for _, value := range values { req.Header.Add(name, value) }
+    }
+    req.Header.Set("Content-Type", "application/x-ndjson")
+    req.Header.Set("Content-Encoding", "gzip")
+    resp, err := p.client.Do(req)
+    if err != nil { return err }
+    io.Copy(io.Discard, resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode > 299 { return fmt.Errorf("status %v", resp.Status) }
+    return nil
+}
+
+// saveCheckpoint writes positions via temporary file, so checkpoint is never half written
+func (p *pusher)saveCheckpoint(series string, pos pushPosition)(error){
+    p.checkpoint[series] = pos
+    data, err := json.Marshal(p.checkpoint)
+    if err != nil { return err }
+    tmp := p.checkpointPath + ".tmp"
+    f, err := os.Create(tmp)
+    if err != nil { return err }
+    _, err = f.Write(data)
+    if err == nil { err = f.Sync() }
+    f.Close()
+    if err != nil { os.Remove(tmp) ; return err }
+    return os.Rename(tmp, p.checkpointPath)
+}
+
+// oldestFile returns oldest inventory entry which may be removed, total size and number of files
+func (r *Runner)oldestFile()(oldest *logFile, totalSize int64, count int){
+    r.inventoryMu.Lock()
+    defer r.inventoryMu.Unlock()
+    for _, file := range r.inventory {
+        totalSize += file.size
+        count     += 1
+        if r.isCompressing(file.name) || r.isCurrentLogFile(file.name) { continue }
+        if oldest == nil || file.mtime.Before(oldest.mtime) { oldest = file }
+    }
+    return
+}
+
+// cleanUp removes oldest files until size, count, age and free space limits are met
 func(r *Runner)cleanUp()(err error){
     //
-    dirSizeMb,err := DirSizeMb(r.log_dir)
-    if err!=nil{return}
-    threshold     := r.log_dir_threshold
-    if dirSizeMb>threshold{
-        fmt.Printf("\nThreshold is fired:\tlog-dir max size threshold: %v\tlog-dir current size: %v",threshold,dirSizeMb)
-        var oldestFile string
-        oldestFile,err = getOldestFile(r.log_dir)
-        oldestFile     = r.log_dir+oldestFile
+    defer r.updatePause()
+    if r.budget != nil {
+        // failed removal isn't handed over again right away, ticker retries it
+        defer func() { if err == nil { r.budget.enforce() } }()
+    }
+    var removed []string
+    defer func() { r.manifestRemove(removed) }()
+    if victim := r.takeBudgetVictim() ; victim != "" {
+        err = r.removeFile(victim)
         if err != nil { return }
-        _, err = os.Stat(oldestFile)
-        if os.IsNotExist(err) { return fileDoesntExist }
-        if  oldestFile == r.currentLogFile { return nil }
-        fmt.Printf("\nRemoving file %v",oldestFile)
-        return os.Remove(oldestFile)
-        //
+        removed = append(removed, filepath.Base(victim))
+    }
+    threshold := int64(r.log_dir_threshold)*1024*1024
+    for {
+        oldest,totalSize,count := r.oldestFile()
+        if oldest == nil { return nil }
+        switch {
+            case r.lowDiskSpace():
+                fmt.Printf("\nThreshold is fired:\tmin free space: %v bytes / %v%%",r.min_free_bytes,r.min_free_percent)
+            case threshold > 0 && totalSize > threshold:
+                fmt.Printf("\nThreshold is fired:\tlog-dir max size threshold: %v\tlog-dir current size: %v",r.log_dir_threshold,totalSize/1024/1024)
+            case r.max_files > 0 && count > r.max_files:
+                fmt.Printf("\nThreshold is fired:\tmax files: %v\tcurrent files: %v",r.max_files,count)
+            case r.max_age > 0 && time.Since(oldest.mtime) > r.max_age:
+                fmt.Printf("\nThreshold is fired:\tmax age: %v\toldest file age: %v",r.max_age,time.Since(oldest.mtime))
+            default:
+                return nil
+        }
+        err = r.removeFile(oldest.name)
+        if err != nil { return }
+        removed = append(removed, filepath.Base(oldest.name))
     }
-    return nil
     //
 }
 
+func (r *Runner)removeFile(name string)(err error){
+    fmt.Printf("\nRemoving file %v",name)
+    err = os.Remove(name)
+    if err != nil && !os.IsNotExist(err) {
+        // keep it in inventory, next run will try again
+        fmt.Printf("\nUnable to remove file %v: %v",name,err)
+        return
+    }
+    r.inventoryRemove(name)
+    atomic.AddInt64(&r.metrics.filesDeleted, 1)
+    return nil
+}
+
+// diskBudget is total-threshold shared by all commands
+type diskBudget struct {
+    limit              int64
+    // started runners
+    runners            []*Runner
+    // runners whose janitor has exited, enforce removes their files itself
+    stopped            map[*Runner]bool
+    mu                 sync.Mutex
+}
+
+func (b *diskBudget)join(r *Runner)(){
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.runners = append(b.runners, r)
+}
+
+func (b *diskBudget)janitorStopped(r *Runner)(){
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.stopped[r] = true
+}
+
+// enforce picks the oldest file of all commands while their total size is over limit and hands it to janitor of its command,
+// that janitor's cleanUp calls enforce again, so files are removed one by one until total size is within limit
+func (b *diskBudget)enforce()(){
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    for {
+        var total  int64
+        var oldest *logFile
+        var owner  *Runner
+        for _, r := range b.runners {
+            file, size, _ := r.oldestFile()
+            total += size
+            if file != nil && (oldest == nil || file.mtime.Before(oldest.mtime)) { oldest, owner = file, r }
+        }
+        if total <= b.limit || oldest == nil { return }
+        fmt.Printf("\nThreshold is fired:\ttotal threshold: %v\tcurrent size of all commands: %v",b.limit,total)
+        if !b.stopped[owner] {
+            owner.setBudgetVictim(oldest.name)
+            owner.requestCleanUp()
+            return
+        }
+        // nobody else touches files of stopped command
+        if owner.removeFile(oldest.name) != nil { return }
+        owner.manifestRemove([]string{filepath.Base(oldest.name)})
+    }
+}
+
+func (r *Runner)setBudgetVictim(name string)(){
+    r.inventoryMu.Lock()
+    defer r.inventoryMu.Unlock()
+    r.budgetVictim = name
+}
+
+// takeBudgetVictim returns file chosen by enforce ("" if there is none or it's already gone)
+func (r *Runner)takeBudgetVictim()(name string){
+    r.inventoryMu.Lock()
+    defer r.inventoryMu.Unlock()
+    name, r.budgetVictim = r.budgetVictim, ""
+    if _, ok := r.inventory[name] ; !ok { return "" }
+    return name
+}
+
+
+// splitCommandLine splits line into argv like POSIX shell does:
+// blanks separate words, 'single' quotes are literal, "double" quotes allow \ escaping of $ ` " \ and newline,
+// unquoted \ escapes next character. Variables and globs are not expanded.
+func splitCommandLine(line string)(args []string, err error){
+    var word  []rune
+    inWord    := false
+    runes     := []rune(line)
+    for i := 0 ; i < len(runes) ; i++ {
+        c := runes[i]
+        switch {
+            case c == ' ' || c == '\t' || c == '\n':
+                if inWord { args = append(args, string(word)) ; word = nil ; inWord = false }
+            case c == '\\':
+                if i+1 < len(runes) {
+                    i++
+                    // backslash-newline is a line continuation
+                    if runes[i] != '\n' { word = append(word, runes[i]) ; inWord = true }
+                }
+            case c == '\'':
+                inWord = true
+                end := i+1
+                for end < len(runes) && runes[end] != '\'' { end++ }
+                if end >= len(runes) { return nil, unterminatedQuote }
+                word = append(word, runes[i+1:end]...)
+                i = end
+            case c == '"':
+                inWord = true
+                i++
+                for ; i < len(runes) && runes[i] != '"' ; i++ {
+                    if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("$`\"\\\n", runes[i+1]) {
+                        i++
+                        if runes[i] == '\n' { continue }
+                    }
+                    word = append(word, runes[i])
+                }
+                if i >= len(runes) { return nil, unterminatedQuote }
+            default:
+                inWord = true
+                word   = append(word, c)
+        }
+    }
+    if inWord { args = append(args, string(word)) }
+    return args, nil
+}
+
+func parseSignal(name string)(syscall.Signal, error){
+    // empty name means "forward the signal which wrapper has received"
+    signals := map[string]syscall.Signal{
+        "INT":  syscall.SIGINT,
+        "TERM": syscall.SIGTERM,
+        "QUIT": syscall.SIGQUIT,
+        "HUP":  syscall.SIGHUP,
+        "USR1": syscall.SIGUSR1,
+        "USR2": syscall.SIGUSR2,
+        "KILL": syscall.SIGKILL,
+    }
+    name = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")
+    if name == "" { return 0, nil }
+    sig, ok := signals[name]
+    if !ok { return 0, badSignal }
+    return sig, nil
+}
+
+// parseMinFree accepts size (2G, 512M) or percentage of filesystem (10%)
+func parseMinFree(value string)(bytes int64, percent float64, err error){
+    value = strings.TrimSpace(value)
+    if strings.HasSuffix(value, "%") {
+        percent, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+        if err != nil || percent < 0 || percent >= 100 { return 0, 0, badMinFree }
+        return 0, percent, nil
+    }
+    bytes, err = parseSize(value)
+    if err != nil { return 0, 0, badMinFree }
+    return bytes, 0, nil
+}
+
+// parseFsync accepts always, rotate, never or sync interval (200ms)
+func parseFsync(value string)(mode string, interval time.Duration, err error){
+    switch value {
+        case fsyncAlways, fsyncRotate, fsyncNever:
+            return value, 0, nil
+    }
+    interval, err = time.ParseDuration(value)
+    if err != nil || interval <= 0 { return "", 0, badFsync }
+    return fsyncInterval, interval, nil
+}
+
+func diskFree(path string)(free uint64, total uint64, err error){
+    var stat syscall.Statfs_t
+    err = syscall.Statfs(path, &stat)
+    if err != nil { return }
+    // Bavail - blocks available to unprivileged user, that's what matters for other services
+    free  = stat.Bavail * uint64(stat.Bsize)
+    total = stat.Blocks * uint64(stat.Bsize)
+    return
+}
+
+func parseSize(value string)(size int64, err error){
+    // 1024, 512K, 10M, 1G (base 1024), empty string means 0
+    value = strings.TrimSpace(strings.ToUpper(value))
+    if value == "" { return 0, nil }
+    value = strings.TrimSuffix(value, "B")
+    multiplier := int64(1)
+    switch {
+        case strings.HasSuffix(value, "K"): multiplier = 1024
+        case strings.HasSuffix(value, "M"): multiplier = 1024*1024
+        case strings.HasSuffix(value, "G"): multiplier = 1024*1024*1024
+        case strings.HasSuffix(value, "T"): multiplier = 1024*1024*1024*1024
+    }
+    if multiplier > 1 { value = value[:len(value)-1] }
+    _, err = fmt.Sscanf(value, "%d", &size)
+    if err != nil || size < 0 || fmt.Sprint(size) != value { return 0, badSize }
+    return size*multiplier, nil
+}
 
 func Command(args []string) (cmd *exec.Cmd,err error) {
     // overwriting existing exec.Command  function 
@@ -278,42 +2254,323 @@ func Command(args []string) (cmd *exec.Cmd,err error) {
     return cmd, nil
 }
 
-func DirSizeMb(path string) (int, error) {
-    var size        int64
-    err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-        if !info.IsDir() {
-            size += info.Size()
+// ownFilePattern matches names of files created by wrapper for cmdName:
+// <cmd>.logfile.<ts>, <cmd>.stderr.logfile.<ts>, optionally with .N uniqueness suffix and .gz or .partial
+// (.partial left after crash is removed by retention as any other file)
+func ownFilePattern(cmdName string)(*regexp.Regexp){
+    return regexp.MustCompile(`^`+regexp.QuoteMeta(cmdName)+`\.(stderr\.)?logfile\.[0-9]{14}(\.[0-9]+)?(\.gz|\.partial)?$`)
+}
+
+// ownFiles lists regular files directly inside dir_path whose names match pattern, subdirectories are not visited
+func ownFiles(dir_path string, pattern *regexp.Regexp)(files []os.FileInfo, err error){
+    entries, err := os.ReadDir(dir_path)
+    if err != nil { return }
+    for _, entry := range entries {
+        if !entry.Type().IsRegular() || !pattern.MatchString(entry.Name()) { continue }
+        info, ierr := entry.Info()
+        // file may be removed meanwhile
+        if ierr != nil { continue }
+        files = append(files, info)
+    }
+    return
+}
+
+// compressFile returns sha256 of the compressed file
+func compressFile(name string)(sum string, err error){
+    // gzip name into name.gz, original is removed only when .gz is completely written
+    gzName := name + ".gz"
+    src, err := os.Open(name)
+    if err != nil { return }
+    defer src.Close()
+    dst, err := os.Create(gzName)
+    if err != nil { return }
+    hasher := sha256.New()
+    zw := gzip.NewWriter(io.MultiWriter(dst, hasher))
+    zw.Name = filepath.Base(name)
+    _, err = io.Copy(zw, src)
+    if err == nil { err = zw.Close() }
+    if err == nil { err = dst.Sync() }
+    if cerr := dst.Close() ; err == nil { err = cerr }
+    if err != nil { os.Remove(gzName) ; return }
+    return hex.EncodeToString(hasher.Sum(nil)), os.Remove(name)
+}
+
+// query prints lines matching -grep from files covering -since..-until, returns exit code
+func query(args []string)(int){
+
+    flags      := flag.NewFlagSet("query", flag.ExitOnError)
+    logDirPtr  := flags.String("log-dir","./","Path to log directory")
+    sincePtr   := flags.String("since","","Start of time range (RFC3339, \"2006-01-02 15:04:05\", \"15:04\" or duration back from now)")
+    untilPtr   := flags.String("until","","End of time range, same formats as since")
+    grepPtr    := flags.String("grep","","Regular expression lines should match")
+    cmdPtr     := flags.String("cmd","","Only files of this command (base name)")
+    flags.Parse(args)
+
+    now        := time.Now()
+    since,err  := parseQueryTime(*sincePtr, now)
+    if err != nil { fmt.Printf("error:since: %v\n",err) ; return 2 }
+    until,err  := parseQueryTime(*untilPtr, now)
+    if err != nil { fmt.Printf("error:until: %v\n",err) ; return 2 }
+    re,err     := regexp.Compile(*grepPtr)
+    if err != nil { fmt.Printf("error:grep: %v\n",err) ; return 2 }
+
+    files,err  := listRotatedFiles(*logDirPtr, *cmdPtr)
+    if err != nil { fmt.Printf("error:%v\n",err) ; return 2 }
+    out        := bufio.NewWriter(os.Stdout)
+    defer out.Flush()
+    matched    := false
+    for _, file := range selectRotatedFiles(files, since, until) {
+        found, err := grepFile(file.path, re, out)
+        if err != nil { fmt.Fprintf(os.Stderr, "%v: %v\n", file.path, err) }
+        matched = matched || found
+    }
+    if !matched { return 1 }
+    return 0
+
+}
+
+func parseQueryTime(value string, now time.Time)(time.Time, error){
+    value = strings.TrimSpace(value)
+    if value == "" { return time.Time{}, nil }
+    if d, err := time.ParseDuration(value) ; err == nil { return now.Add(-d), nil }
+    if t, err := time.Parse(time.RFC3339Nano, value) ; err == nil { return t, nil }
+    // file names carry local time, so plain layouts are local too
+    layouts := []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02", "20060102150405"}
+    for _, layout := range layouts {
+        if t, err := time.ParseInLocation(layout, value, time.Local) ; err == nil { return t, nil }
+    }
+    for _, layout := range []string{"15:04:05", "15:04"} {
+        if t, err := time.ParseInLocation(layout, value, time.Local) ; err == nil {
+            return time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local), nil
         }
-        return err
+    }
+    return time.Time{}, badTime
+}
+
+// rotatedNamePattern matches cmd, series, start, sequence number and suffix of wrapper's files
+var rotatedNamePattern = regexp.MustCompile(`^(.+?)\.(stderr\.)?logfile\.([0-9]{14})(\.[0-9]+)?(\.gz|\.partial)?$`)
+
+// parseRotatedName parses name of file (without directory) written by wrapper
+func parseRotatedName(name string)(file rotatedFile, ok bool){
+    m := rotatedNamePattern.FindStringSubmatch(name)
+    if m == nil { return file, false }
+    file = rotatedFile{path:name, cmd:m[1], series:strings.TrimSuffix(m[2], ".")}
+    file.start, _ = time.ParseInLocation("20060102150405", m[3], time.Local)
+    if m[4] != "" { file.seq, _ = strconv.Atoi(m[4][1:]) }
+    return file, true
+}
+
+// scanRotatedFiles lists files of cmdName (all if empty) sorted by start time and sequence number
+func scanRotatedFiles(dir string, cmdName string)(files []rotatedFile, err error){
+    entries, err := os.ReadDir(dir)
+    if err != nil { return }
+    for _, entry := range entries {
+        file, ok := parseRotatedName(entry.Name())
+        if !ok || !entry.Type().IsRegular() { continue }
+        if cmdName != "" && file.cmd != cmdName { continue }
+        file.path = filepath.Join(dir, entry.Name())
+        files = append(files, file)
+    }
+    sort.SliceStable(files, func(i, j int)(bool){
+        if !files[i].start.Equal(files[j].start) { return files[i].start.Before(files[j].start) }
+        return files[i].seq < files[j].seq
     })
-    sizeMB := int(size) / 1024 / 1024
-    return sizeMB, err
-}
-
-func getOldestFile(dir_path string) (filename string,err error) {
-    first_iter := true
-    var fTgtName  string
-    var fTgtMtime time.Time
-
-    err = filepath.Walk(dir_path, func(_ string, info os.FileInfo, err error) error {
-        if !info.IsDir() {
-            fname  := info.Name()
-            fmtime := info.ModTime()
-            if first_iter {
-                fTgtName   = fname
-                fTgtMtime  = fmtime
-                first_iter = false
+    return
+}
+
+// listRotatedFiles finds wrapper's files in dir (of any command if cmdName is empty) ordered by creation,
+// first/last times are taken from manifests when they are there
+func listRotatedFiles(dir string, cmdName string)(files []rotatedFile, err error){
+    files, err = scanRotatedFiles(dir, cmdName)
+    if err != nil { return }
+    entries, err := os.ReadDir(dir)
+    if err != nil { return }
+    manifest := make(map[string]manifestEntry)
+    for _, entry := range entries {
+        if !strings.HasSuffix(entry.Name(), ".index.jsonl") { continue }
+        readManifest(filepath.Join(dir, entry.Name()), manifest)
+    }
+    for i := range files {
+        if e, ok := manifest[filepath.Base(files[i].path)] ; ok { files[i].first, files[i].last = e.First, e.Last }
+    }
+    return
+}
+
+func readManifest(name string, entries map[string]manifestEntry)(){
+    f, err := os.Open(name)
+    if err != nil { return }
+    defer f.Close()
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+    for scanner.Scan() {
+        var entry manifestEntry
+        if json.Unmarshal(scanner.Bytes(), &entry) == nil { entries[entry.File] = entry }
+    }
+}
+
+// selectRotatedFiles keeps files which may contain lines from since..until (zero time - open range).
+// Without manifest a file is assumed to cover time from its creation till creation of next file of the same series.
+func selectRotatedFiles(files []rotatedFile, since time.Time, until time.Time)(selected []rotatedFile){
+    for i, file := range files {
+        first, last := file.first, file.last
+        if first.IsZero() { first = file.start }
+        if last.IsZero() {
+            for _, next := range files[i+1:] {
+                if next.cmd == file.cmd && next.series == file.series && next.start.After(file.start) { last = next.start ; break }
             }
-            if fmtime.Before(fTgtMtime){
-                fTgtName   = fname
-                fTgtMtime  = fmtime
+        }
+        if !until.IsZero() && first.After(until) { continue }
+        if !since.IsZero() && !last.IsZero() && last.Before(since) { continue }
+        selected = append(selected, file)
+    }
+    return
+}
+
+// openRotatedFile opens plain or gzip compressed file
+func openRotatedFile(name string)(io.ReadCloser, error){
+    f, err := os.Open(name)
+    if err != nil { return nil, err }
+    if !strings.HasSuffix(name, ".gz") { return f, nil }
+    zr, err := gzip.NewReader(f)
+    if err != nil { f.Close() ; return nil, err }
+    return struct{ io.Reader ; io.Closer }{zr, f}, nil
+}
+
+func grepFile(name string, re *regexp.Regexp, out io.Writer)(matched bool, err error){
+    f, err := openRotatedFile(name)
+    if err != nil { return }
+    defer f.Close()
+    reader := bufio.NewReader(f)
+    for lineNo := 1 ; ; lineNo++ {
+        line, rerr := reader.ReadString('\n')
+        if line != "" {
+            line = strings.TrimSuffix(line, "\n")
+            if re.MatchString(line) {
+                matched = true
+                fmt.Fprintf(out, "%v:%v:%v\n", filepath.Base(name), lineNo, line)
             }
         }
-        return err
-    })
-    return fTgtName, err
+        if rerr == io.EOF { return }
+        if rerr != nil { return matched, rerr }
+    }
 }
 
+// follow streams lines of the newest file and switches to next files as they appear, returns exit code
+func follow(args []string)(int){
+
+    flags       := flag.NewFlagSet("follow", flag.ExitOnError)
+    logDirPtr   := flags.String("log-dir","./","Path to log directory")
+    cmdPtr      := flags.String("cmd","","Only files of this command (base name)")
+    seriesPtr   := flags.String("series","","Series to follow (\"\" - main, \"stderr\")")
+    linesPtr    := flags.Int("n",0,"Print this number of last lines before following")
+    intervalPtr := flags.Duration("interval",500*time.Millisecond,"How often new data and files are checked")
+    flags.Parse(args)
+
+    list := func()([]rotatedFile, error){
+        all, err := listRotatedFiles(*logDirPtr, *cmdPtr)
+        var files []rotatedFile
+        for _, file := range all {
+            if file.series == *seriesPtr { files = append(files, file) }
+        }
+        return files, err
+    }
+    files, err := list()
+    if err != nil { fmt.Printf("error:%v\n",err) ; return 2 }
+    out := bufio.NewWriter(os.Stdout)
+    if *linesPtr > 0 { printLastLines(files, *linesPtr, out) }
+    out.Flush()
+
+    var current   *rotatedFile
+    var f         *os.File
+    var offset    int64
+    var pending   string
+    if len(files) > 0 {
+        // start from the end of newest file
+        current = &files[len(files)-1]
+        f, err = openFollowed(current.path)
+        if err == nil { offset, _ = f.Seek(0, io.SeekEnd) }
+    }
+    for {
+        if f != nil { offset, pending = readNewLines(f, offset, pending, out) }
+        files, err = list()
+        if err != nil { fmt.Fprintf(os.Stderr, "%v\n", err) }
+        next := nextRotatedFile(files, current)
+        if next != nil {
+            if f != nil {
+                // whatever was written before rotation
+                offset, pending = readNewLines(f, offset, pending, out)
+                if pending != "" { fmt.Fprintln(out, pending) ; pending = "" }
+                f.Close()
+            }
+            current, f, offset = next, nil, 0
+            if strings.HasSuffix(current.path, ".gz") {
+                // file is already finished and compressed, nothing will be appended to it
+                printLastLines([]rotatedFile{*current}, -1, out)
+            } else {
+                f, err = openFollowed(current.path)
+                if err != nil { fmt.Fprintf(os.Stderr, "%v: %v\n", current.path, err) }
+            }
+            out.Flush()
+            continue
+        }
+        out.Flush()
+        time.Sleep(*intervalPtr)
+    }
+
+}
+
+// openFollowed opens file which may be renamed from .partial to its final name meanwhile
+func openFollowed(name string)(f *os.File, err error){
+    f, err = os.Open(name)
+    if os.IsNotExist(err) && strings.HasSuffix(name, partialSuffix) {
+        f, err = os.Open(strings.TrimSuffix(name, partialSuffix))
+    }
+    return
+}
+
+// readNewLines prints complete lines appended after offset, incomplete tail is returned as pending
+func readNewLines(f *os.File, offset int64, pending string, out io.Writer)(int64, string){
+    buf := make([]byte, 64*1024)
+    for {
+        n, err := f.ReadAt(buf, offset)
+        offset += int64(n)
+        data   := pending + string(buf[:n])
+        lines  := strings.Split(data, "\n")
+        pending = lines[len(lines)-1]
+        for _, line := range lines[:len(lines)-1] { fmt.Fprintln(out, line) }
+        if err != nil || n == 0 { return offset, pending }
+    }
+}
+
+// nextRotatedFile returns the first file created after current (files are ordered), any file if current is nil
+func nextRotatedFile(files []rotatedFile, current *rotatedFile)(*rotatedFile){
+    for i := range files {
+        file := &files[i]
+        if current == nil { return file }
+        if file.start.After(current.start) || (file.start.Equal(current.start) && file.seq > current.seq) { return file }
+    }
+    return nil
+}
+
+// printLastLines prints last n lines of files (all lines if n < 0)
+func printLastLines(files []rotatedFile, n int, out io.Writer)(){
+    var tail []string
+    for i := len(files)-1 ; i >= 0 && (n < 0 || len(tail) < n) ; i-- {
+        f, err := openRotatedFile(files[i].path)
+        if os.IsNotExist(err) && strings.HasSuffix(files[i].path, partialSuffix) {
+            f, err = openRotatedFile(strings.TrimSuffix(files[i].path, partialSuffix))
+        }
+        if err != nil { continue }
+        var lines []string
+        scanner := bufio.NewScanner(f)
+        scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+        for scanner.Scan() { lines = append(lines, scanner.Text()) }
+        f.Close()
+        tail = append(lines, tail...)
+    }
+    if n >= 0 && len(tail) > n { tail = tail[len(tail)-n:] }
+    for _, line := range tail { fmt.Fprintln(out, line) }
+}
 
 func avg_file_size()(){}
 func delta()(){ }
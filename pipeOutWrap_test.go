@@ -0,0 +1,710 @@
+package main
+
+import "testing"
+import "fmt"
+import "flag"
+import "os"
+import "io"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "path/filepath"
+import "compress/gzip"
+import "encoding/json"
+import "encoding/base64"
+import "bufio"
+import "regexp"
+import "strings"
+import "reflect"
+import "sync"
+import "time"
+//
+
+func TestSplitCommandLine(t *testing.T){
+    tests := []struct{
+        line           string
+        args           []string
+        err            error
+    }{
+        {"", nil, nil},
+        {"  a b\t c ", []string{"a", "b", "c"}, nil},
+        {"tcpdump -l -i 'any port' x", []string{"tcpdump", "-l", "-i", "any port", "x"}, nil},
+        {`echo "a \"b\" \$x \n"`, []string{"echo", `a "b" $x \n`}, nil},
+        {`a\ b c`, []string{"a b", "c"}, nil},
+        {"a\\\nb", []string{"ab"}, nil},
+        {`''`, []string{""}, nil},
+        {`a 'b`, nil, unterminatedQuote},
+        {`a "b`, nil, unterminatedQuote},
+    }
+    for _, tt := range tests {
+        args, err := splitCommandLine(tt.line)
+        if err != tt.err || !reflect.DeepEqual(args, tt.args) {
+            t.Errorf("splitCommandLine(%q) = %q, %v; want %q, %v", tt.line, args, err, tt.args, tt.err)
+        }
+    }
+}
+
+func TestParseSize(t *testing.T){
+    tests := []struct{
+        value          string
+        size           int64
+        err            error
+    }{
+        {"", 0, nil},
+        {"1024", 1024, nil},
+        {"512K", 512*1024, nil},
+        {"10m", 10*1024*1024, nil},
+        {"2GB", 2*1024*1024*1024, nil},
+        {" 1T ", 1024*1024*1024*1024, nil},
+        {"-1", 0, badSize},
+        {"1.5G", 0, badSize},
+        {"G", 0, badSize},
+        {"ten", 0, badSize},
+    }
+    for _, tt := range tests {
+        size, err := parseSize(tt.value)
+        if size != tt.size || err != tt.err {
+            t.Errorf("parseSize(%q) = %v, %v; want %v, %v", tt.value, size, err, tt.size, tt.err)
+        }
+    }
+}
+
+func TestParseMinFree(t *testing.T){
+    tests := []struct{
+        value          string
+        bytes          int64
+        percent        float64
+        err            error
+    }{
+        {"2G", 2*1024*1024*1024, 0, nil},
+        {"10%", 0, 10, nil},
+        {"0.5%", 0, 0.5, nil},
+        {"100%", 0, 0, badMinFree},
+        {"-1%", 0, 0, badMinFree},
+        {"x%", 0, 0, badMinFree},
+        {"lots", 0, 0, badMinFree},
+    }
+    for _, tt := range tests {
+        bytes, percent, err := parseMinFree(tt.value)
+        if bytes != tt.bytes || percent != tt.percent || err != tt.err {
+            t.Errorf("parseMinFree(%q) = %v, %v, %v; want %v, %v, %v", tt.value, bytes, percent, err, tt.bytes, tt.percent, tt.err)
+        }
+    }
+}
+
+func TestParseFsync(t *testing.T){
+    tests := []struct{
+        value          string
+        mode           string
+        interval       time.Duration
+        err            error
+    }{
+        {"always", fsyncAlways, 0, nil},
+        {"rotate", fsyncRotate, 0, nil},
+        {"never", fsyncNever, 0, nil},
+        {"200ms", fsyncInterval, 200*time.Millisecond, nil},
+        {"0s", "", 0, badFsync},
+        {"-1s", "", 0, badFsync},
+        {"sometimes", "", 0, badFsync},
+    }
+    for _, tt := range tests {
+        mode, interval, err := parseFsync(tt.value)
+        if mode != tt.mode || interval != tt.interval || err != tt.err {
+            t.Errorf("parseFsync(%q) = %v, %v, %v; want %v, %v, %v", tt.value, mode, interval, err, tt.mode, tt.interval, tt.err)
+        }
+    }
+}
+
+func TestParseQueryTime(t *testing.T){
+    now := time.Date(2024, 5, 1, 16, 30, 0, 0, time.Local)
+    tests := []struct{
+        value          string
+        want           time.Time
+        err            error
+    }{
+        {"", time.Time{}, nil},
+        {"30m", now.Add(-30*time.Minute), nil},
+        {"2024-05-01T14:00:00Z", time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC), nil},
+        {"2024-05-01 14:00", time.Date(2024, 5, 1, 14, 0, 0, 0, time.Local), nil},
+        {"2024-05-01 14:00:05", time.Date(2024, 5, 1, 14, 0, 5, 0, time.Local), nil},
+        {"20240501140005", time.Date(2024, 5, 1, 14, 0, 5, 0, time.Local), nil},
+        {"09:15", time.Date(2024, 5, 1, 9, 15, 0, 0, time.Local), nil},
+        {"yesterday", time.Time{}, badTime},
+    }
+    for _, tt := range tests {
+        got, err := parseQueryTime(tt.value, now)
+        if !got.Equal(tt.want) || err != tt.err {
+            t.Errorf("parseQueryTime(%q) = %v, %v; want %v, %v", tt.value, got, err, tt.want, tt.err)
+        }
+    }
+}
+
+func TestRedact(t *testing.T){
+    tests := []struct{
+        re             string
+        text           string
+        want           string
+    }{
+        {`secret`, "a secret b secret", "a *** b ***"},
+        {`Authorization: \S+ (\S+)`, "Authorization: Bearer abc def", "Authorization: Bearer *** def"},
+        {`user=(\w+) pass=(\w+)`, "user=bob pass=x1", "user=*** pass=***"},
+        {`(a)|(b)`, "abc", "******c"},
+        {`nomatch`, "text", "text"},
+    }
+    for _, tt := range tests {
+        got := redact(tt.text, regexp.MustCompile(tt.re), "***")
+        if got != tt.want { t.Errorf("redact(%q, %q) = %q; want %q", tt.text, tt.re, got, tt.want) }
+    }
+}
+
+func TestApplyRules(t *testing.T){
+    var rules []*filterRule
+    for _, rule := range []struct{ action, re string }{{ruleExclude, `^debug`}, {ruleInclude, `tcp`}, {ruleRedact, `port (\d+)`}} {
+        ruleFlag{action:rule.action, rules:&rules}.Set(rule.re)
+    }
+    r := &Runner{rules:rules, redact_mask:"X"}
+    tests := []struct{
+        text           string
+        want           string
+        keep           bool
+    }{
+        {"debug tcp port 22", "", false},
+        {"udp port 53", "", false},
+        {"tcp port 22", "tcp port X", true},
+        {"tcp", "tcp", true},
+    }
+    for _, tt := range tests {
+        got, keep := r.applyRules(tt.text)
+        if got != tt.want || keep != tt.keep { t.Errorf("applyRules(%q) = %q, %v; want %q, %v", tt.text, got, keep, tt.want, tt.keep) }
+    }
+    for i, want := range []int64{1, 1, 1} {
+        if rules[i].matched != want { t.Errorf("rule %v matched %v lines; want %v", i, rules[i].matched, want) }
+    }
+}
+
+func TestValidateName(t *testing.T){
+    for _, tt := range []struct{ name string ; err error }{{"lo", nil}, {"tcpdump.eth0", nil}, {".", badName}, {"..", badName}, {"a/b", badName}} {
+        cfg, err := parseArgs("test", flag.ContinueOnError, []string{"-count=10", "-name=" + tt.name, "--", "/usr/bin/app"})
+        if err != nil { t.Fatal(err) }
+        err = cfg.validate()
+        if err != tt.err { t.Errorf("validate() of name %q = %v; want %v", tt.name, err, tt.err) }
+    }
+}
+
+// writeTestFile writes content to dir/name, gzipped if name ends with .gz
+func writeTestFile(t *testing.T, dir string, name string, content string)(string){
+    path := filepath.Join(dir, name)
+    f, err := os.Create(path)
+    if err != nil { t.Fatal(err) }
+    defer f.Close()
+    var w io.Writer = f
+    if strings.HasSuffix(name, ".gz") {
+        zw := gzip.NewWriter(f)
+        defer zw.Close()
+        w = zw
+    }
+    _, err = io.WriteString(w, content)
+    if err != nil { t.Fatal(err) }
+    return path
+}
+
+func TestReadPushBatch(t *testing.T){
+    dir := t.TempDir()
+    for _, name := range []string{"app.logfile.20240501140000", "app.logfile.20240501140000.gz"} {
+        path := writeTestFile(t, dir, name, "a\nbb\nccc")
+        tests := []struct{
+            offset     int64
+            max        int
+            finished   bool
+            lines      []string
+            offsets    []int64
+            next       int64
+        }{
+            {0, 10, true, []string{"a", "bb", "ccc"}, []int64{0, 2, 5}, 8},
+            {0, 10, false, []string{"a", "bb"}, []int64{0, 2}, 5},
+            {2, 1, true, []string{"bb"}, []int64{2}, 5},
+            {5, 10, true, []string{"ccc"}, []int64{5}, 8},
+            {8, 10, true, nil, nil, 8},
+            {20, 10, true, nil, nil, 20},
+        }
+        for _, tt := range tests {
+            lines, offsets, next, err := readPushBatch(path, tt.offset, tt.max, tt.finished)
+            if err != nil || !reflect.DeepEqual(lines, tt.lines) || !reflect.DeepEqual(offsets, tt.offsets) || next != tt.next {
+                t.Errorf("readPushBatch(%v, %v, %v, %v) = %q, %v, %v, %v; want %q, %v, %v",
+                    name, tt.offset, tt.max, tt.finished, lines, offsets, next, err, tt.lines, tt.offsets, tt.next)
+            }
+        }
+    }
+}
+
+// pushRecord is a line of request body posted by pusher with -format=text
+type pushRecord struct {
+    Host               string `json:"host"`
+    Cmd                string `json:"cmd"`
+    File               string `json:"file"`
+    Offset             int64  `json:"offset"`
+    Line               string `json:"line"`
+}
+
+// collector is a push-url endpoint which fails first requests
+type collector struct {
+    mu                 sync.Mutex
+    failures           int
+    records            []pushRecord
+    headers            []http.Header
+}
+
+func (c *collector)ServeHTTP(w http.ResponseWriter, req *http.Request)(){
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.headers = append(c.headers, req.Header.Clone())
+    if c.failures > 0 {
+        c.failures--
+        w.WriteHeader(http.StatusServiceUnavailable)
+        return
+    }
+    zr, err := gzip.NewReader(req.Body)
+    if err != nil { w.WriteHeader(http.StatusBadRequest) ; return }
+    scanner := bufio.NewScanner(zr)
+    for scanner.Scan() {
+        var record pushRecord
+        if json.Unmarshal(scanner.Bytes(), &record) != nil { w.WriteHeader(http.StatusBadRequest) ; return }
+        c.records = append(c.records, record)
+    }
+}
+
+func newTestPusher(t *testing.T, dir string, url string)(*pusher){
+    cfg := Config{cmd:[]string{"/usr/bin/app"}, push_url:url, push_batch:2, push_backoff_max:time.Second, format:formatText,
+        push_header:http.Header{"Authorization":{"Bearer token"}}}
+    p, err := newPusher(cfg, dir+"/", "host1", []string{""})
+    if err != nil { t.Fatal(err) }
+    return p
+}
+
+// pushAll runs pusher until it has nothing more to send
+func pushAll(t *testing.T, p *pusher)(){
+    for i := 0 ; i < 100 ; i++ {
+        progressed, err := p.pushPending()
+        if err != nil { t.Fatal(err) }
+        if !progressed { return }
+    }
+    t.Fatal("pusher didn't finish")
+}
+
+func TestPusher(t *testing.T){
+    dir := t.TempDir()
+    c   := &collector{failures:1}
+    srv := httptest.NewServer(c)
+    defer srv.Close()
+    // .10 sorts before .9 as a string, but it was written later
+    writeTestFile(t, dir, "app.logfile.20240501140000.gz", "l1\nl2\nl3\n")
+    writeTestFile(t, dir, "app.logfile.20240501140000.9", "l4\n")
+    writeTestFile(t, dir, "app.logfile.20240501140000.10", "l5\n")
+    writeTestFile(t, dir, "app.logfile.20240501150000.partial", "l6\nl7")
+    writeTestFile(t, dir, "other.logfile.20240501140000", "x\n")
+    p := newTestPusher(t, dir, srv.URL)
+    _, err := p.pushPending()
+    if err != nil { t.Fatal(err) }
+    _, err = p.pushPending()
+    if err == nil { t.Fatal("error of failed request wasn't returned") }
+    pushAll(t, p)
+    var lines []string
+    for _, record := range c.records {
+        lines = append(lines, record.Line)
+        if record.Host != "host1" || record.Cmd != "app" { t.Errorf("bad record %+v", record) }
+    }
+    // l7 isn't complete yet
+    if want := []string{"l1", "l2", "l3", "l4", "l5", "l6"} ; !reflect.DeepEqual(lines, want) {
+        t.Fatalf("pushed %q; want %q", lines, want)
+    }
+    if r := c.records[2] ; r.File != "app.logfile.20240501140000" || r.Offset != 6 { t.Errorf("bad position of l3: %+v", r) }
+    for _, h := range c.headers {
+        if h.Get("Authorization") != "Bearer token" || h.Get("Content-Encoding") != "gzip" || h.Get("Content-Type") != "application/x-ndjson" {
+            t.Errorf("bad headers %v", h)
+        }
+    }
+    // file is finished, pusher continues from checkpoint after restart
+    os.Rename(filepath.Join(dir, "app.logfile.20240501150000.partial"), filepath.Join(dir, "app.logfile.20240501150000"))
+    p = newTestPusher(t, dir, srv.URL)
+    pushAll(t, p)
+    if n := len(c.records) ; n != 7 || c.records[n-1].Line != "l7" || c.records[n-1].Offset != 3 {
+        t.Errorf("records after restart: %+v", c.records[6:])
+    }
+    data, err := os.ReadFile(filepath.Join(dir, "app.push.json"))
+    if err != nil { t.Fatal(err) }
+    var checkpoint map[string]pushPosition
+    json.Unmarshal(data, &checkpoint)
+    if want := (pushPosition{File:"app.logfile.20240501150000", Offset:5}) ; checkpoint[""] != want {
+        t.Errorf("checkpoint %+v; want %+v", checkpoint[""], want)
+    }
+}
+
+func TestPusherRemovedFile(t *testing.T){
+    dir := t.TempDir()
+    c   := &collector{}
+    srv := httptest.NewServer(c)
+    defer srv.Close()
+    writeTestFile(t, dir, "app.logfile.20240501140000.10", "l10\n")
+    checkpoint := `{"":{"file":"app.logfile.20240501140000.9","offset":3}}`
+    os.WriteFile(filepath.Join(dir, "app.push.json"), []byte(checkpoint), 0644)
+    p := newTestPusher(t, dir, srv.URL)
+    pushAll(t, p)
+    if len(c.records) != 1 || c.records[0].Line != "l10" { t.Errorf("pushed %+v; want l10", c.records) }
+    if p.lost != 1 { t.Errorf("lost %v files; want 1", p.lost) }
+}
+
+func TestSyslogMessage(t *testing.T){
+    received := time.Date(2024, 5, 1, 14, 0, 0, 123456000, time.UTC)
+    line     := Line{stream:"stderr", text:"disk full", received:received, pid:42}
+    want     := "<11>1 2024-05-01T14:00:00.123456Z host1 my_app 42 stderr - disk full"
+
+    udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    defer udp.Close()
+    w, err := newSyslogWriter("udp://"+udp.LocalAddr().String(), syslogFacilities["user"], syslogSeverities["err"], "my app", "host1")
+    if err != nil { t.Fatal(err) }
+    go w.run()
+    w.send(line)
+    buf := make([]byte, 1024)
+    udp.SetReadDeadline(time.Now().Add(5*time.Second))
+    n, _, err := udp.ReadFrom(buf)
+    if err != nil { t.Fatal(err) }
+    if string(buf[:n]) != want { t.Errorf("udp message %q; want %q", buf[:n], want) }
+    w.stop(time.Second)
+
+    tcp, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    defer tcp.Close()
+    w, err = newSyslogWriter("tcp://"+tcp.Addr().String(), syslogFacilities["user"], syslogSeverities["err"], "my app", "host1")
+    if err != nil { t.Fatal(err) }
+    go w.run()
+    w.send(line)
+    w.send(line)
+    conn, err := tcp.Accept()
+    if err != nil { t.Fatal(err) }
+    defer conn.Close()
+    conn.SetReadDeadline(time.Now().Add(5*time.Second))
+    framed := strings.Repeat(fmt.Sprintf("%d %s", len(want), want), 2)
+    got    := make([]byte, len(framed))
+    _, err  = io.ReadFull(conn, got)
+    if err != nil { t.Fatal(err) }
+    if string(got) != framed { t.Errorf("tcp stream %q; want %q", got, framed) }
+    w.stop(time.Second)
+    if w.sent != 2 || w.dropped != 0 { t.Errorf("sent %v dropped %v; want 2 and 0", w.sent, w.dropped) }
+}
+
+func TestNewSyslogWriter(t *testing.T){
+    for _, target := range []string{"udp://", "unix://", "http://host:514", "host:514"} {
+        _, err := newSyslogWriter(target, 1, 6, "app", "host")
+        if err != badSyslog { t.Errorf("newSyslogWriter(%q) error %v; want %v", target, err, badSyslog) }
+    }
+}
+
+func TestNextRotation(t *testing.T){
+    // zone with half-hour offset, boundaries counted from UTC would fall on :30
+    local := time.FixedZone("IST", 5*3600+1800)
+    at    := func(day int, hour int, min int, sec int)(time.Time){ return time.Date(2024, 5, day, hour, min, sec, 0, local) }
+    tests := []struct{
+        interval       time.Duration
+        align          bool
+        opened         time.Time
+        want           time.Time
+    }{
+        {0, true, at(1, 14, 20, 10), time.Time{}},
+        {time.Hour, false, at(1, 14, 20, 10), at(1, 15, 20, 10)},
+        {time.Hour, true, at(1, 14, 20, 10), at(1, 15, 0, 0)},
+        {time.Hour, true, at(1, 14, 0, 0), at(1, 15, 0, 0)},
+        {7*time.Minute, true, at(1, 14, 20, 10), at(1, 14, 21, 0)},
+        {7*time.Minute, true, at(1, 23, 55, 0), at(2, 0, 0, 0)},
+        {24*time.Hour, true, at(1, 14, 20, 10), at(2, 0, 0, 0)},
+        // 5h doesn't divide a day: 00, 05, 10, 15, 20 and next midnight
+        {5*time.Hour, true, at(1, 14, 20, 10), at(1, 15, 0, 0)},
+        {5*time.Hour, true, at(1, 22, 0, 0), at(2, 0, 0, 0)},
+    }
+    for _, tt := range tests {
+        r   := &Runner{rotate_interval:tt.interval, rotate_align:tt.align}
+        got := r.nextRotation(tt.opened)
+        if !got.Equal(tt.want) { t.Errorf("nextRotation(%v) with interval %v align %v = %v; want %v", tt.opened, tt.interval, tt.align, got, tt.want) }
+    }
+}
+
+func TestFormatLineMonotonic(t *testing.T){
+    first  := time.Now()
+    second := first.Add(10*time.Second)
+    r      := &Runner{format:formatText, timestamp:timestampMonotonic, stderr_mode:stderrNone}
+    // cmd was restarted, line of the first process is still waiting in channel
+    r.started = second
+    tests := []struct{
+        line           Line
+        want           string
+    }{
+        {Line{text:"old", received:first.Add(9500*time.Millisecond), started:first}, "+9.500000 old"},
+        {Line{text:"new", received:second.Add(250*time.Millisecond), started:second}, "+0.250000 new"},
+    }
+    for _, tt := range tests {
+        if got := r.formatLine(tt.line) ; got != tt.want { t.Errorf("formatLine(%q) = %q; want %q", tt.line.text, got, tt.want) }
+    }
+}
+
+func TestFormatJSONLine(t *testing.T){
+    r := &Runner{cmd_line:[]string{"/usr/bin/app"}, hostname:"host1", format:formatJSON}
+    received := time.Date(2024, 5, 1, 14, 0, 0, 0, time.UTC)
+    tests := []struct{
+        text           string
+        line           string
+        base64         bool
+    }{
+        {"plain ü line", "plain ü line", false},
+        {"bad \xff\xfe bytes \xc3", "bad \uFFFD bytes \uFFFD", true},
+    }
+    for _, tt := range tests {
+        s := r.formatLine(Line{stream:"stdout", text:tt.text, received:received, pid:42, seq:7})
+        if !json.Valid([]byte(s)) { t.Fatalf("invalid JSON %q", s) }
+        var obj map[string]interface{}
+        json.Unmarshal([]byte(s), &obj)
+        if obj["line"] != tt.line || obj["host"] != "host1" || obj["cmd"] != "app" || obj["pid"] != 42.0 || obj["seq"] != 7.0 || obj["ts"] != "2024-05-01T14:00:00Z" {
+            t.Errorf("formatLine(%q) = %v", tt.text, s)
+        }
+        encoded, ok := obj["line_base64"].(string)
+        if ok != tt.base64 { t.Errorf("formatLine(%q) has line_base64: %v; want %v", tt.text, ok, tt.base64) }
+        if !ok { continue }
+        original, err := base64.StdEncoding.DecodeString(encoded)
+        if err != nil || string(original) != tt.text { t.Errorf("line_base64 of %q decodes to %q, %v", tt.text, original, err) }
+    }
+}
+
+func TestWriteMetrics(t *testing.T){
+    var runners []*Runner
+    for _, name := range []string{"app", `b"x`} {
+        r := newTestRunner(t.TempDir(), fsyncNever)
+        r.name    = name
+        r.metrics = runnerMetrics{
+            received:map[string]*streamMetrics{"stdout":{}, "stderr":{}},
+            dropped:map[string]*int64{"stdout":new(int64), "stderr":new(int64)},
+            exits:map[string]int64{"exit code 1":2},
+        }
+        runners = append(runners, r)
+    }
+    // regex with backslash, double quote and newline which are escaped and tab which is kept (unlike %q)
+    ruleFlag{action:ruleExclude, rules:&runners[0].rules}.Set("\\.\"\n\t")
+    var out strings.Builder
+    writeMetrics(&out, runners)
+    text := out.String()
+
+    headers := make(map[string]int)
+    family  := ""
+    for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+        fields := strings.Fields(line)
+        switch {
+            case strings.HasPrefix(line, "# HELP "):
+                headers[fields[2]] += 1
+                family = fields[2]
+            case strings.HasPrefix(line, "# TYPE "):
+                if fields[2] != family { t.Errorf("TYPE of %v follows HELP of %v", fields[2], family) }
+            case !strings.HasPrefix(line, family):
+                // samples of family are written together after its header
+                t.Errorf("sample %q isn't under its family header %v", line, family)
+        }
+    }
+    for name, n := range headers {
+        if n != 1 { t.Errorf("header of %v is written %v times", name, n) }
+    }
+    for _, want := range []string{
+        `pipeoutwrap_files_deleted_total{cmd="app"} 0`,
+        `pipeoutwrap_files_deleted_total{cmd="b\"x"} 0`,
+        `pipeoutwrap_child_exits_total{cmd="b\"x",status="exit code 1"} 2`,
+        "pipeoutwrap_rule_lines_total{cmd=\"app\",rule=\"0\",action=\"exclude\",regex=\"\\\\.\\\"\\n\t\"} 0",
+    } {
+        if !strings.Contains(text, want + "\n") { t.Errorf("metrics don't contain %v", want) }
+    }
+}
+
+// readTestFiles returns lines of all files in dir
+func readTestFiles(t *testing.T, dir string)(lines []string){
+    files, err := scanRotatedFiles(dir, "")
+    if err != nil { t.Fatal(err) }
+    for _, file := range files {
+        data, err := os.ReadFile(file.path)
+        if err != nil { t.Fatal(err) }
+        lines = append(lines, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")...)
+    }
+    return
+}
+
+func TestBackpressure(t *testing.T){
+    tests := []struct{
+        policy         string
+        lines          []string
+    }{
+        {backpressureDropNewest, []string{"line 1", "line 2", "line 6"}},
+        {backpressureDropOldest, []string{"line 4", "line 5", "line 6"}},
+    }
+    for _, tt := range tests {
+        dir := t.TempDir()
+        r   := newTestRunner(dir, fsyncNever)
+        r.cmd_line       = []string{"app"}
+        r.backpressure   = tt.policy
+        r.ch             = make(chan Line, 2)
+        r.droppedPending = map[chan Line]*int64{r.ch:new(int64)}
+        r.metrics.dropped = map[string]*int64{"stdout":new(int64)}
+        line := func(i int)(Line){ return Line{stream:"stdout", text:fmt.Sprintf("line %v", i), received:time.Now()} }
+        // handle isn't running yet, so buffer of 2 lines overflows
+        for i := 1 ; i <= 5 ; i++ { r.enqueue(r.ch, line(i)) }
+        if n := *r.metrics.dropped["stdout"] ; n != 3 { t.Errorf("%v: dropped %v lines; want 3", tt.policy, n) }
+        r.handleWg.Add(1)
+        go r.handle(r.ch, "", nil)
+        // next line fits into buffer once handle took buffered ones
+        for deadline := time.Now().Add(5*time.Second) ; len(r.ch) > 0 && time.Now().Before(deadline) ; { time.Sleep(time.Millisecond) }
+        r.enqueue(r.ch, line(6))
+        close(r.ch)
+        r.handleWg.Wait()
+        lines  := readTestFiles(t, dir)
+        marker := regexp.MustCompile(`^--- 3 lines dropped, writer fell behind \(backpressure ` + tt.policy + `, buffer 2\) ---$`)
+        if len(lines) != 4 || !marker.MatchString(lines[0]) || !reflect.DeepEqual(lines[1:], tt.lines) {
+            t.Errorf("%v: written %q; want marker of 3 lines and %q", tt.policy, lines, tt.lines)
+        }
+        if n := *r.droppedPending[r.ch] ; n != 0 { t.Errorf("%v: %v dropped lines weren't reported", tt.policy, n) }
+    }
+}
+
+// newTestRunner returns runner which is able to run handle and cleanUp only
+func newTestRunner(dir string, fsync string)(*Runner){
+    mode, interval, _  := parseFsync(fsync)
+    r                  := &Runner{}
+    r.cmd_line          = []string{"bench"}
+    r.log_dir           = dir + "/"
+    r.count             = 100000
+    r.fsync             = mode
+    r.fsync_interval    = interval
+    r.format            = formatText
+    r.timestamp         = timestampNone
+    r.stderr_mode       = stderrNone
+    r.inventory         = make(map[string]*logFile)
+    r.currentLogFiles   = make(map[string]string)
+    r.compressing       = make(map[string]bool)
+    r.cleanUpRequest    = make(chan bool, 1)
+    return r
+}
+
+// addTestFile creates empty file of r which is age old and puts it to inventory with size
+func addTestFile(t *testing.T, r *Runner, name string, size int64, age time.Duration)(string){
+    path  := writeTestFile(t, r.log_dir, name, "")
+    mtime := time.Now().Add(-age)
+    os.Chtimes(path, mtime, mtime)
+    r.inventoryPut(path, size, mtime)
+    return path
+}
+
+// checkFiles fails test if existence of files differs from want
+func checkFiles(t *testing.T, want map[string]bool)(){
+    for path, exists := range want {
+        _, err := os.Stat(path)
+        if (err == nil) != exists { t.Errorf("%v exists: %v; want %v", filepath.Base(path), err == nil, exists) }
+    }
+}
+
+func TestCleanUp(t *testing.T){
+    const mb = 1024*1024
+    tests := []struct{
+        name           string
+        threshold      int
+        maxFiles       int
+        maxAge         time.Duration
+        // size active file has grown to since it was opened
+        currentSize    int64
+        left           []string
+    }{
+        {"threshold", 2, 0, 0, 0, []string{"cur", "comp", "new"}},
+        {"threshold counts active file", 4, 0, 0, 2*mb, []string{"cur", "comp", "new"}},
+        {"max files", 0, 4, 0, 0, []string{"cur", "comp", "old2", "new"}},
+        {"max age", 0, 0, 5*time.Hour, 0, []string{"cur", "comp", "new"}},
+        {"within limits", 10, 10, 24*time.Hour, 0, []string{"cur", "comp", "old1", "old2", "new"}},
+    }
+    for _, tt := range tests {
+        r := newTestRunner(t.TempDir(), fsyncNever)
+        r.log_dir_threshold = tt.threshold
+        r.max_files         = tt.maxFiles
+        r.max_age           = tt.maxAge
+        // active and compressing files are the oldest ones, but they are never removed
+        files := map[string]string{
+            "cur":  addTestFile(t, r, "app.logfile.1.partial", 0, 10*time.Hour),
+            "comp": addTestFile(t, r, "app.logfile.2", mb, 9*time.Hour),
+            "old1": addTestFile(t, r, "app.logfile.3", mb, 8*time.Hour),
+            "old2": addTestFile(t, r, "app.logfile.4", mb, 7*time.Hour),
+            "new":  addTestFile(t, r, "app.logfile.5", mb, 1*time.Hour),
+        }
+        r.setCurrentLogFile("", files["cur"])
+        r.inventoryResize(files["cur"], tt.currentSize)
+        r.compressing[filepath.Clean(files["comp"])] = true
+        err := r.cleanUp()
+        if err != nil { t.Fatal(err) }
+        want := make(map[string]bool)
+        for _, path := range files { want[path] = false }
+        for _, name := range tt.left { want[files[name]] = true }
+        checkFiles(t, want)
+        _, _, count := r.oldestFile()
+        if count != len(tt.left) || r.metrics.filesDeleted != int64(len(files)-len(tt.left)) {
+            t.Errorf("%v: %v files in inventory, %v deleted; want %v left", tt.name, count, r.metrics.filesDeleted, len(tt.left))
+        }
+    }
+}
+
+func TestDiskBudget(t *testing.T){
+    budget := &diskBudget{limit:250, stopped:make(map[*Runner]bool)}
+    a := newTestRunner(t.TempDir(), fsyncNever)
+    b := newTestRunner(t.TempDir(), fsyncNever)
+    c := newTestRunner(t.TempDir(), fsyncNever)
+    // d wasn't started, it doesn't join budget
+    d := newTestRunner(t.TempDir(), fsyncNever)
+    for _, r := range []*Runner{a, b, c, d} { r.budget = budget }
+    a1 := addTestFile(t, a, "a.logfile.1", 100, 5*time.Hour)
+    a2 := addTestFile(t, a, "a.logfile.2", 100, 1*time.Hour)
+    b1 := addTestFile(t, b, "b.logfile.1", 100, 3*time.Hour)
+    c1 := addTestFile(t, c, "c.logfile.1", 100, 10*time.Hour)
+    c2 := addTestFile(t, c, "c.logfile.2", 100, 2*time.Hour)
+    d1 := addTestFile(t, d, "d.logfile.1", 100, 20*time.Hour)
+    budget.join(a)
+    budget.join(b)
+    budget.join(c)
+    budget.janitorStopped(c)
+
+    // file of stopped c is removed right away, a1 is handed to janitor of a
+    budget.enforce()
+    checkFiles(t, map[string]bool{a1:true, a2:true, b1:true, c1:false, c2:true, d1:true})
+    if a.budgetVictim != a1 || len(a.cleanUpRequest) != 1 { t.Fatalf("a1 wasn't handed to janitor of a: victim %q, requests %v", a.budgetVictim, len(a.cleanUpRequest)) }
+    if len(b.cleanUpRequest) != 0 { t.Errorf("janitor of b was woken up") }
+
+    // janitor of a removes a1 and hands b1 to janitor of b, after that total is within limit
+    <-a.cleanUpRequest
+    a.cleanUp()
+    if b.budgetVictim != b1 || len(b.cleanUpRequest) != 1 { t.Fatalf("b1 wasn't handed to janitor of b: victim %q", b.budgetVictim) }
+    <-b.cleanUpRequest
+    b.cleanUp()
+    checkFiles(t, map[string]bool{a1:false, a2:true, b1:false, c1:false, c2:true, d1:true})
+    for _, r := range []*Runner{a, b, c, d} {
+        if r.budgetVictim != "" || len(r.cleanUpRequest) != 0 { t.Errorf("%v has pending victim %q", r.log_dir, r.budgetVictim) }
+    }
+    for r, want := range map[*Runner]int64{a:1, b:1, c:1, d:0} {
+        if r.metrics.filesDeleted != want { t.Errorf("%v deleted %v files; want %v", r.log_dir, r.metrics.filesDeleted, want) }
+    }
+}
+
+// benchmarkHandle writes b.N lines of 100 bytes through handle with fsync policy
+func benchmarkHandle(b *testing.B, fsync string)(){
+    r    := newTestRunner(b.TempDir(), fsync)
+    ch   := make(chan Line, 100)
+    text := strings.Repeat("x", 100)
+    r.droppedPending = map[chan Line]*int64{ch:new(int64)}
+    b.SetBytes(int64(len(text)+1))
+    b.ResetTimer()
+    r.handleWg.Add(1)
+    go r.handle(ch, "", nil)
+    for i := 0; i < b.N; i++ { ch<-Line{stream:"stdout", text:text, received:time.Now()} }
+    close(ch)
+    r.handleWg.Wait()
+}
+
+func BenchmarkHandleFsyncAlways(b *testing.B){ benchmarkHandle(b, fsyncAlways) }
+func BenchmarkHandleFsyncInterval(b *testing.B){ benchmarkHandle(b, "100ms") }
+func BenchmarkHandleFsyncRotate(b *testing.B){ benchmarkHandle(b, fsyncRotate) }
+func BenchmarkHandleFsyncNever(b *testing.B){ benchmarkHandle(b, fsyncNever) }